@@ -0,0 +1,616 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// the files written next to the extracted attachments: the manifest for
+// scripts, and the index as a checklist for attaching them by hand.
+const (
+	attachmentsManifest  = "manifest.json"
+	attachmentsIndexCSV  = "index.csv"
+	attachmentsIndexHTML = "index.html"
+)
+
+// sniffedExtensions maps the content types detected by http.DetectContentType
+// to the extension an attachment of that content is named with.
+var sniffedExtensions = map[string]string{
+	"image/jpeg":         ".jpg",
+	"image/png":          ".png",
+	"image/gif":          ".gif",
+	"image/webp":         ".webp",
+	"image/bmp":          ".bmp",
+	"image/x-icon":       ".ico",
+	"application/pdf":    ".pdf",
+	"application/zip":    ".zip",
+	"application/x-gzip": ".gz",
+	"text/plain":         ".txt",
+	"text/html":          ".html",
+	"text/xml":           ".xml",
+}
+
+// extensionTypes maps lower cased extensions to the content type a file of
+// that name must have.  Extensions not listed, such as .docx which is a zip,
+// are never reported as a mismatch.
+var extensionTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".pdf":  "application/pdf",
+	".zip":  "application/zip",
+	".gz":   "application/x-gzip",
+	".txt":  "text/plain",
+}
+
+// inlineFormat is the block an inlined text attachment is added to the notes
+// as, with its name before and after the content.
+var inlineFormat = `----- Attachment: %s -----
+%s
+----- End of %s -----`
+
+// attachmentOptions are how an attachmentStore extracts attachments.
+type attachmentOptions struct {
+	// PerCard extracts every card into its own directory.
+	PerCard bool
+
+	// Dedup stores identical attachments only once.
+	Dedup bool
+
+	// InlineMax is the size up to which UTF-8 text attachments are inlined
+	// into the notes instead of extracted, or 0 to never inline.
+	InlineMax int
+
+	// Zip packages the attachments of every card into a single zip.
+	Zip bool
+
+	// the attachments to skip: images, anything larger than MaxSize if not
+	// 0, anything without one of IncludeExts or with one of ExcludeExts, and
+	// every attachment of a card without one of IncludeLabels or with one of
+	// ExcludeLabels.  Extensions are lower cased and without the dot, labels
+	// are compared ignoring case.
+	SkipImages    bool
+	MaxSize       int
+	IncludeExts   []string
+	ExcludeExts   []string
+	IncludeLabels []string
+	ExcludeLabels []string
+}
+
+// attachmentStore extracts the attachments of the cards into a directory,
+// for formats that cannot import them, and records where each one went.
+//
+// Every file is named after the card's ID and title, and the position of the
+// attachment on the card, so that names are deterministic across runs and
+// cards with the same title never overwrite each other.  Identical files are
+// stored only once if Dedup is set.
+type attachmentStore struct {
+	dir  string
+	opts attachmentOptions
+
+	paths   map[string]string // lower cased path -> sha256 of its content
+	hashes  map[string]string // sha256 -> path it was stored at
+	records []attachmentRecord
+}
+
+// attachmentRecord is the manifest entry of a single attachment of a card.
+type attachmentRecord struct {
+	CardID   string `json:"card_id"`
+	Title    string `json:"title"`
+	Folder   string `json:"folder"`
+	Modified string `json:"modified,omitempty"`
+
+	// Name is the name stored in SafeInCloud, empty for images.
+	// NameMismatch is set if its extension does not match the MIMEType
+	// detected from the content.
+	Name         string `json:"name,omitempty"`
+	Image        bool   `json:"image,omitempty"`
+	MIMEType     string `json:"mime_type"`
+	NameMismatch bool   `json:"name_mismatch,omitempty"`
+
+	// Path is where the content was stored, relative to the attachments
+	// directory, and ZipEntry its name inside of Path if it is the card's zip.
+	// Deduplicated is set if the content was stored once for an earlier card,
+	// and Path is that file.  Inlined is set, and Path empty, if the content
+	// was inlined into the notes instead, and Skipped is why it was not
+	// extracted at all.
+	Path         string `json:"path,omitempty"`
+	ZipEntry     string `json:"zip_entry,omitempty"`
+	Size         int    `json:"size"`
+	SHA256       string `json:"sha256"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+	Inlined      bool   `json:"inlined,omitempty"`
+	Skipped      string `json:"skipped,omitempty"`
+}
+
+func newAttachmentStore(dir string, opts attachmentOptions) *attachmentStore {
+	return &attachmentStore{
+		dir:    dir,
+		opts:   opts,
+		paths:  map[string]string{},
+		hashes: map[string]string{},
+	}
+}
+
+// extract saves all of the entry's attachments to disk, and returns the
+// attachments that were inlined instead as blocks of text to add to the notes.
+// The entries of a card share their attachments, so it must only be called
+// once per card.
+//
+// A card is extracted as a whole or not at all: if any of its files cannot be
+// written, those already written for it are removed again and the store is
+// left as it was before the card.
+func (s *attachmentStore) extract(e entry) (notes string, err error) {
+	var written []string
+	defer func() {
+		if err != nil {
+			s.rollback(e, written)
+		}
+	}()
+
+	var records []attachmentRecord
+	var inlined []string
+	var zipped []zipFile
+	for i, a := range e.Attachments {
+		sum := sha256.Sum256(a.Data)
+		r := attachmentRecord{
+			CardID:   e.CardID,
+			Title:    e.Title,
+			Folder:   e.Folder,
+			Modified: e.Modified,
+			Name:     a.Name,
+			Image:    a.Image,
+			Size:     len(a.Data),
+			SHA256:   hex.EncodeToString(sum[:]),
+			MIMEType: sniffType(a.Data),
+		}
+		var name string
+		name, r.NameMismatch = attachmentFilename(i, a, r.MIMEType)
+		if r.NameMismatch {
+			logger.Warn("attachment content does not match its name", "card", e.CardID, "file", a.Name, "type", r.MIMEType)
+		}
+
+		if r.Skipped = s.skip(e, a, name); r.Skipped != "" {
+			logger.Info("attachment skipped", "card", e.CardID, "file", name, "reason", r.Skipped)
+			records = append(records, r)
+			continue
+		}
+
+		if s.inline(a, r.MIMEType) {
+			logger.Info("text attachment inlined into the notes", "card", e.CardID, "file", a.Name)
+			text := strings.TrimRight(string(a.Data), "\r\n")
+			inlined = append(inlined, fmt.Sprintf(inlineFormat, a.Name, text, a.Name))
+			r.Inlined = true
+			records = append(records, r)
+			continue
+		}
+
+		if s.opts.Zip {
+			zipped = append(zipped, zipFile{name: name, data: a.Data})
+			r.ZipEntry = name
+			records = append(records, r)
+			continue
+		}
+
+		if p, ok := s.hashes[r.SHA256]; ok && s.opts.Dedup {
+			logV(3, "attachment already extracted for another card", "card", e.CardID, "attachment", i)
+			r.Path, r.Deduplicated = p, true
+			records = append(records, r)
+			continue
+		}
+
+		if r.Path = s.uniquePath(s.attachmentPath(e, name), r.SHA256); r.Path != s.attachmentPath(e, name) {
+			logger.Warn("attachment name collides with another attachment, renaming", "card", e.CardID, "attachment", i)
+		}
+		if err := s.store(r.Path, r.SHA256, a.Data, &written); err != nil {
+			return "", errors.Wrap(err, "store returned error")
+		}
+		if a.Image {
+			logger.Warn("image attachment saved", "card", e.CardID, "attachment", i)
+		} else {
+			logger.Warn("file attachment saved", "card", e.CardID, "attachment", i, "file", a.Name)
+		}
+		records = append(records, r)
+	}
+
+	if len(zipped) > 0 {
+		p, err := s.writeZip(e, zipped, &written)
+		if err != nil {
+			return "", errors.Wrap(err, "writeZip returned error")
+		}
+		for i := range records {
+			if records[i].ZipEntry != "" {
+				records[i].Path = p
+			}
+		}
+		logger.Warn("attachments saved", "card", e.CardID, "files", len(zipped))
+	}
+	s.records = append(s.records, records...)
+	return strings.Join(inlined, "\n\n"), nil
+}
+
+// skip returns why the attachment, named name, of the entry's card is not to
+// be extracted, or "" to extract it.
+func (s *attachmentStore) skip(e entry, a attachment, name string) string {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	switch {
+	case a.Image && s.opts.SkipImages:
+		return "image"
+	case s.opts.MaxSize > 0 && len(a.Data) > s.opts.MaxSize:
+		return "size"
+	case len(s.opts.IncludeExts) > 0 && !containsString(s.opts.IncludeExts, ext),
+		containsString(s.opts.ExcludeExts, ext):
+		return "extension"
+	case len(s.opts.IncludeLabels) > 0 && !hasLabel(e.Labels, s.opts.IncludeLabels),
+		hasLabel(e.Labels, s.opts.ExcludeLabels):
+		return "label"
+	}
+	return ""
+}
+
+// splitList splits a comma delimited flag value, trimming spaces and leaving
+// out empty items.
+func splitList(raw string) []string {
+	var list []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// splitExts splits a comma delimited list of extensions, as "pdf,.JPG", into
+// lower cased extensions without the dot.
+func splitExts(raw string) []string {
+	var exts []string
+	for _, v := range splitList(raw) {
+		exts = append(exts, strings.TrimPrefix(strings.ToLower(v), "."))
+	}
+	return exts
+}
+
+// hasLabel returns true if any of labels is one of names, ignoring case.
+func hasLabel(labels, names []string) bool {
+	for _, l := range labels {
+		for _, n := range names {
+			if strings.EqualFold(strings.TrimSpace(l), n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// zipFile is a single file to package into a card's zip.
+type zipFile struct {
+	name string
+	data []byte
+}
+
+// zipTime is the modification time of every file in a card's zip, the
+// earliest a zip can hold, so the same files always give the same zip.
+var zipTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeZip packages the files of the entry's card into "ID_Title.zip" and
+// returns its path relative to the attachments directory.
+func (s *attachmentStore) writeZip(e entry, files []zipFile, written *[]string) (string, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: zipTime})
+		if err != nil {
+			return "", errors.Wrap(err, "zip.CreateHeader error")
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return "", errors.Wrap(err, "zip write error")
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", errors.Wrap(err, "zip.Close error")
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	hash := hex.EncodeToString(sum[:])
+	p := s.uniquePath(escapeFilename(e.CardID+"_"+e.Title)+".zip", hash)
+	if p != escapeFilename(e.CardID+"_"+e.Title)+".zip" {
+		logger.Warn("attachment name collides with another attachment, renaming", "card", e.CardID)
+	}
+	if err := s.store(p, hash, buf.Bytes(), written); err != nil {
+		return "", errors.Wrap(err, "store returned error")
+	}
+	return p, nil
+}
+
+// inline returns true if the attachment is small enough, valid UTF-8 text to
+// be inlined into the notes.
+func (s *attachmentStore) inline(a attachment, mimeType string) bool {
+	return s.opts.InlineMax > 0 && !a.Image && len(a.Data) <= s.opts.InlineMax &&
+		mimeType == "text/plain" && utf8.Valid(a.Data)
+}
+
+// attachmentFilename returns the file name of the i-th attachment of a card,
+// "i_name", and whether its name does not match its content.
+//
+// SafeInCloud does not keep the name of images, so images are named by their
+// position and the extension of their content, "i.jpg" unless sniffed
+// otherwise.  A file without an extension, or whose extension contradicts its
+// content, gets the extension of its content added.
+func attachmentFilename(i int, a attachment, mimeType string) (string, bool) {
+	if a.Image {
+		return strconv.Itoa(i) + imageExt(mimeType), false
+	}
+	ext := sniffedExtensions[mimeType]
+	name := strconv.Itoa(i) + "_" + a.Name
+	have := strings.ToLower(path.Ext(a.Name))
+	switch {
+	case ext == "":
+		return name, false
+	case have == "":
+		return name + ext, false
+	case extensionTypes[have] == "" || sameType(extensionTypes[have], mimeType):
+		return name, false
+	}
+	return name + ext, true
+}
+
+// imageExt returns the extension of an image of the sniffed mimeType, ".jpg"
+// unless it is another image type, as SafeInCloud mostly stores JPEGs.
+func imageExt(mimeType string) string {
+	if ext := sniffedExtensions[mimeType]; ext != "" && strings.HasPrefix(mimeType, "image/") {
+		return ext
+	}
+	return ".jpg"
+}
+
+// imageFilename returns the file name of the n-th image of an entry,
+// "image_n" with the extension of its content, for the formats that embed
+// attachments by name.
+func imageFilename(n int, data []byte) string {
+	return "image_" + strconv.Itoa(n) + imageExt(sniffType(data))
+}
+
+// sniffType returns the MIME type of data, without any parameters, detected
+// from its first bytes.
+func sniffType(data []byte) string {
+	t := http.DetectContentType(data)
+	if n := strings.Index(t, ";"); n >= 0 {
+		t = t[:n]
+	}
+	return t
+}
+
+// sameType returns true if a and b are the same MIME type.  Text is too hard
+// to tell apart by content, so all text types are the same.
+func sameType(a, b string) bool {
+	return a == b || (strings.HasPrefix(a, "text/") && strings.HasPrefix(b, "text/"))
+}
+
+// attachmentPath returns the path, relative to the attachments directory, of
+// the attachment called name of the entry's card: "ID_Title_name" or, with
+// perCard, "ID_Title/name".
+func (s *attachmentStore) attachmentPath(e entry, name string) string {
+	card := e.CardID + "_" + e.Title
+	if s.opts.PerCard {
+		return escapeFilename(card) + "/" + escapeFilename(name)
+	}
+	return escapeFilename(card + "_" + name)
+}
+
+// uniquePath returns p, or p with a number added before its extension if p
+// was already used for different content.  Paths are compared ignoring case,
+// as they would collide on a case-insensitive file system.
+//
+// Paths hold the card's title, so it is up to the caller to log a rename by
+// the card's ID.
+func (s *attachmentStore) uniquePath(p, sum string) string {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for n := 2; ; n++ {
+		prev, ok := s.paths[strings.ToLower(p)]
+		if !ok || prev == sum {
+			return p
+		}
+		p = base + "_" + strconv.Itoa(n) + ext
+	}
+}
+
+// escapeFilename makes name safe to use as a single file name.
+func escapeFilename(name string) string {
+	name = url.QueryEscape(name)
+	return strings.Replace(name, "%20", " ", -1)
+}
+
+// store writes data to the path p inside of the attachments directory and
+// records it under its sha256 sum.  A path not stored before is appended to
+// written, for rollback to remove if the rest of the card fails.
+func (s *attachmentStore) store(p, sum string, data []byte, written *[]string) error {
+	if err := s.dumpfile(p, data); err != nil {
+		return errors.Wrap(err, "dumpfile returned error")
+	}
+	if _, ok := s.paths[strings.ToLower(p)]; !ok {
+		*written = append(*written, p)
+	}
+	s.paths[strings.ToLower(p)] = sum
+	if _, ok := s.hashes[sum]; !ok {
+		s.hashes[sum] = p
+	}
+	return nil
+}
+
+// rollback removes the files written for the entry's card, and forgets them,
+// after the card failed half way through.
+func (s *attachmentStore) rollback(e entry, written []string) {
+	for i, p := range written {
+		sum := s.paths[strings.ToLower(p)]
+		delete(s.paths, strings.ToLower(p))
+		if s.hashes[sum] == p {
+			delete(s.hashes, sum)
+		}
+		if err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(p))); err != nil && !os.IsNotExist(err) {
+			logger.Error("unable to remove attachment of failed card", "card", e.CardID, "file", i, "err", err)
+			continue
+		}
+		logger.Warn("removed attachment of failed card", "card", e.CardID, "file", i)
+	}
+}
+
+// dumpfile will dump the binary contents of data to the path inside of the
+// attachments directory.
+func (s *attachmentStore) dumpfile(p string, data []byte) error {
+	fullpath := filepath.Join(s.dir, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(fullpath), 0700); err != nil {
+		return errors.Wrap(err, "os.MkdirAll returned error")
+	}
+	if err := writeFileAtomic(fullpath, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return errors.Wrap(err, "writeFileAtomic returned error")
+	}
+	return nil
+}
+
+// write writes the manifest and index of every extracted attachment into the
+// attachments directory.
+func (s *attachmentStore) write() error {
+	if err := s.writeManifest(); err != nil {
+		return errors.Wrap(err, "writeManifest error")
+	}
+	if err := s.writeIndexCSV(); err != nil {
+		return errors.Wrap(err, "writeIndexCSV error")
+	}
+	if err := s.writeIndexHTML(); err != nil {
+		return errors.Wrap(err, "writeIndexHTML error")
+	}
+	return nil
+}
+
+// writeManifest writes the manifest of every extracted attachment into the
+// attachments directory, or removes a stale one if nothing was extracted.
+func (s *attachmentStore) writeManifest() error {
+	filename := filepath.Join(s.dir, attachmentsManifest)
+	if len(s.records) == 0 {
+		return removeStale(filename)
+	}
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.records); err != nil {
+			return errors.Wrap(err, "json.Encode error")
+		}
+		return nil
+	})
+}
+
+// indexRecords returns the records of extracted files in the order of the
+// LastPass vault: by folder, then entry name, then card.  Inlined and skipped
+// attachments need no attaching, and are left out.
+func (s *attachmentStore) indexRecords() []attachmentRecord {
+	var records []attachmentRecord
+	for _, r := range s.records {
+		if !r.Inlined && r.Skipped == "" {
+			records = append(records, r)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Folder != b.Folder {
+			return a.Folder < b.Folder
+		}
+		if a.Title != b.Title {
+			return a.Title < b.Title
+		}
+		return a.CardID < b.CardID
+	})
+	return records
+}
+
+// writeIndexCSV writes the index of the attachments as a csv, with an empty
+// "attached" column to tick off in a spreadsheet.  As it is meant to be
+// opened in one, every cell is neutralized with safeCell.
+func (s *attachmentStore) writeIndexCSV() error {
+	var rows [][]string
+	for _, r := range s.indexRecords() {
+		rows = append(rows, []string{"", r.Folder, r.Title, r.CardID, r.Name, r.Path, strconv.Itoa(r.Size), r.MIMEType, r.Modified})
+	}
+	header := []string{"attached", "folder", "name", "card_id", "attachment", "file", "size", "type", "modified"}
+	return writeCSV(filepath.Join(s.dir, attachmentsIndexCSV), header, rows, true)
+}
+
+// indexHTML is the template of index.html.  The checkboxes are not saved, it
+// is a checklist for a single sitting.
+var indexHTML = template.Must(template.New(attachmentsIndexHTML).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>sic2lp attachments</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.size { text-align: right; }
+tr:has(input:checked) { color: #999; text-decoration: line-through; }
+</style>
+</head>
+<body>
+<h1>Attachments to attach in LastPass</h1>
+<p>Open each entry in LastPass, attach the file and tick it off.</p>
+<table>
+<tr><th>Attached</th><th>Folder</th><th>Name</th><th>Card ID</th><th>Attachment</th><th>File</th><th>Size</th><th>Type</th><th>Modified</th></tr>
+{{range .}}<tr><td><input type="checkbox"></td><td>{{.Folder}}</td><td>{{.Title}}</td><td>{{.CardID}}</td><td>{{if .Image}}(image){{else}}{{.Name}}{{end}}</td><td><a href="{{.Href}}">{{.Path}}</a></td><td class="size">{{.Size}}</td><td>{{.MIMEType}}</td><td>{{.Modified}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeIndexHTML writes the index of the attachments as a page linking to
+// every file, with a checkbox to tick off each one once attached.
+func (s *attachmentStore) writeIndexHTML() error {
+	filename := filepath.Join(s.dir, attachmentsIndexHTML)
+	records := s.indexRecords()
+	if len(records) == 0 {
+		return removeStale(filename)
+	}
+	type row struct {
+		attachmentRecord
+		Href string
+	}
+	var rows []row
+	for _, r := range records {
+		// the file names are already query escaped, so the link must escape
+		// the % of those escapes again.
+		var segments []string
+		for _, seg := range strings.Split(r.Path, "/") {
+			segments = append(segments, url.PathEscape(seg))
+		}
+		rows = append(rows, row{r, strings.Join(segments, "/")})
+	}
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		if err := indexHTML.Execute(w, rows); err != nil {
+			return errors.Wrap(err, "template.Execute error")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var bitwardenFile string
+
+func init() {
+	registerFormat("bitwarden", "Bitwarden unencrypted JSON export, written to -bitwarden", newBitwardenExporter)
+
+	flag.StringVar(&bitwardenFile, "bitwarden", "bitwarden.json", "Output path and filename for -format bitwarden.")
+}
+
+// Bitwarden item types, see https://bitwarden.com/help/condition-bitwarden-import/
+const (
+	bitwardenTypeLogin      = 1
+	bitwardenTypeSecureNote = 2
+	bitwardenTypeCard       = 3
+	bitwardenTypeIdentity   = 4
+)
+
+// Bitwarden custom field types.
+const (
+	bitwardenFieldText   = 0
+	bitwardenFieldHidden = 1
+)
+
+// bitwardenExport is an unencrypted Bitwarden JSON export.
+type bitwardenExport struct {
+	Encrypted bool              `json:"encrypted"`
+	Folders   []bitwardenFolder `json:"folders"`
+	Items     []bitwardenItem   `json:"items"`
+}
+
+// bitwardenFolder is a Bitwarden folder, referenced by items by ID.
+type bitwardenFolder struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// bitwardenItem is a single Bitwarden vault item.  Only one of Login,
+// SecureNote, Card or Identity is set, depending on Type.
+type bitwardenItem struct {
+	ID             string               `json:"id"`
+	OrganizationID *string              `json:"organizationId"`
+	FolderID       *string              `json:"folderId"`
+	Type           int                  `json:"type"`
+	Reprompt       int                  `json:"reprompt"`
+	Name           string               `json:"name"`
+	Notes          *string              `json:"notes"`
+	Favorite       bool                 `json:"favorite"`
+	Fields         []bitwardenField     `json:"fields,omitempty"`
+	Login          *bitwardenLogin      `json:"login,omitempty"`
+	SecureNote     *bitwardenSecureNote `json:"secureNote,omitempty"`
+	Card           *bitwardenCard       `json:"card,omitempty"`
+	Identity       *bitwardenIdentity   `json:"identity,omitempty"`
+	CollectionIDs  []string             `json:"collectionIds"`
+
+	// folder is the name of the folder, resolved to FolderID on write.
+	folder string
+}
+
+// bitwardenField is a custom field of an item.
+type bitwardenField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Type  int    `json:"type"`
+}
+
+type bitwardenLogin struct {
+	URIs     []bitwardenURI `json:"uris"`
+	Username string         `json:"username"`
+	Password string         `json:"password"`
+	TOTP     *string        `json:"totp"`
+}
+
+type bitwardenURI struct {
+	Match *int   `json:"match"`
+	URI   string `json:"uri"`
+}
+
+type bitwardenSecureNote struct {
+	Type int `json:"type"`
+}
+
+type bitwardenCard struct {
+	CardholderName string `json:"cardholderName"`
+	Brand          string `json:"brand"`
+	Number         string `json:"number"`
+	ExpMonth       string `json:"expMonth"`
+	ExpYear        string `json:"expYear"`
+	Code           string `json:"code"`
+}
+
+type bitwardenIdentity struct {
+	FirstName      string `json:"firstName"`
+	LastName       string `json:"lastName"`
+	Country        string `json:"country"`
+	PassportNumber string `json:"passportNumber"`
+}
+
+// bitwardenExporter writes an unencrypted Bitwarden JSON export.
+type bitwardenExporter struct {
+	items []bitwardenItem
+}
+
+func newBitwardenExporter() (Exporter, error) {
+	return &bitwardenExporter{}, nil
+}
+
+// Add converts every entry to a Bitwarden item: sites become login items,
+// notes become secure notes, except for notes of the Credit Card and Passport
+// NoteTypes that become card and identity items.
+func (x *bitwardenExporter) Add(entries []entry) error {
+	for _, e := range entries {
+		x.items = append(x.items, bitwardenItemFor(e))
+	}
+	return nil
+}
+
+// Write writes all items to bitwardenFile.
+func (x *bitwardenExporter) Write() error {
+	return writeBitwardenJSON(bitwardenFile, x.items)
+}
+
+// bitwardenItemFor converts a single entry to a Bitwarden item.
+func bitwardenItemFor(e entry) bitwardenItem {
+	used := map[int]bool{}
+	switch {
+	case e.Kind == entrySite:
+		item := newBitwardenItem(e, bitwardenTypeLogin)
+		item.Login = &bitwardenLogin{
+			URIs:     []bitwardenURI{{URI: e.URL}},
+			Username: e.Username,
+			Password: e.Password,
+		}
+		if e.OTP != "" {
+			totp := e.OTP
+			item.Login.TOTP = &totp
+		}
+		for i, f := range e.Fields {
+			if f.Role != "" {
+				used[i] = true
+			}
+		}
+		item.Fields = bitwardenFields(e, used)
+		return item
+	case e.NoteType == "Credit Card":
+		item := newBitwardenItem(e, bitwardenTypeCard)
+		item.Card = bitwardenCreditCard(e, used)
+		item.Fields = bitwardenFields(e, used)
+		return item
+	case e.NoteType == "Passport":
+		item := newBitwardenItem(e, bitwardenTypeIdentity)
+		item.Identity = bitwardenPassport(e, used)
+		item.Fields = bitwardenFields(e, used)
+		return item
+	}
+	item := newBitwardenItem(e, bitwardenTypeSecureNote)
+	item.SecureNote = &bitwardenSecureNote{}
+	item.Fields = bitwardenFields(e, used)
+	return item
+}
+
+// newBitwardenItem returns an item of type t with the properties common to
+// all item types filled in from the entry.
+func newBitwardenItem(e entry, t int) bitwardenItem {
+	notes := e.Notes
+	if labels := strings.Join(e.Labels, ", "); len(labels) > 0 {
+		if notes != "" {
+			notes = notes + "\n\n"
+		}
+		notes = notes + "Labels: " + labels
+	}
+	item := bitwardenItem{
+		ID:       newUUID(),
+		Type:     t,
+		Name:     e.Title,
+		Favorite: e.Favorite,
+		folder:   e.Folder,
+	}
+	if notes != "" {
+		item.Notes = &notes
+	}
+	return item
+}
+
+// bitwardenFields returns every field of the entry not already used as a
+// custom field.  Secret fields are hidden fields.
+func bitwardenFields(e entry, used map[int]bool) []bitwardenField {
+	var fields []bitwardenField
+	for i, f := range e.Fields {
+		if used[i] {
+			continue
+		}
+		t := bitwardenFieldText
+		if isSecretType(f.Type) {
+			t = bitwardenFieldHidden
+		}
+		fields = append(fields, bitwardenField{Name: f.Name, Value: f.Value, Type: t})
+	}
+	return fields
+}
+
+// bitwardenCreditCard fills in a Bitwarden card from the fields named like the
+// common credit card fields, marking the fields it used.
+func bitwardenCreditCard(e entry, used map[int]bool) *bitwardenCard {
+	card := &bitwardenCard{}
+	for i, f := range e.Fields {
+		switch {
+		case f.Type == "expiry" || fieldNamed(f, "expires", "expiration", "expiration date", "exp", "valid thru"):
+			card.ExpMonth, card.ExpYear = parseExpiry(f.Value)
+		case fieldNamed(f, "name on card", "owner", "cardholder", "cardholder name", "name"):
+			card.CardholderName = f.Value
+		case fieldNamed(f, "number", "card number", "card #"):
+			card.Number = f.Value
+		case fieldNamed(f, "cvv", "cvc", "cvv2", "security code", "code"):
+			card.Code = f.Value
+		case fieldNamed(f, "brand", "type"):
+			card.Brand = f.Value
+		default:
+			continue
+		}
+		used[i] = true
+	}
+	if card.Brand == "" {
+		card.Brand = cardBrand(card.Number)
+	}
+	return card
+}
+
+// bitwardenPassport fills in a Bitwarden identity from the fields named like
+// the common passport fields, marking the fields it used.
+func bitwardenPassport(e entry, used map[int]bool) *bitwardenIdentity {
+	id := &bitwardenIdentity{}
+	for i, f := range e.Fields {
+		switch {
+		case fieldNamed(f, "number", "passport number", "passport #", "passport no"):
+			id.PassportNumber = f.Value
+		case fieldNamed(f, "name", "full name"):
+			id.FirstName, id.LastName = f.Value, ""
+			if n := strings.LastIndex(f.Value, " "); n > 0 {
+				id.FirstName, id.LastName = f.Value[:n], f.Value[n+1:]
+			}
+		case fieldNamed(f, "country", "nationality"):
+			id.Country = f.Value
+		default:
+			continue
+		}
+		used[i] = true
+	}
+	return id
+}
+
+// fieldNamed returns true if the field's name is one of names, ignoring case.
+func fieldNamed(f entryField, names ...string) bool {
+	for _, n := range names {
+		if strings.EqualFold(strings.TrimSpace(f.Name), n) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpiry splits a SafeInCloud expiry such as "04/21" or "4/2021" into
+// a month and a four digit year.
+func parseExpiry(v string) (month, year string) {
+	parts := strings.SplitN(strings.TrimSpace(v), "/", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	month = strings.TrimLeft(strings.TrimSpace(parts[0]), "0")
+	year = strings.TrimSpace(parts[1])
+	if len(year) == 2 {
+		year = "20" + year
+	}
+	return month, year
+}
+
+// cardBrand guesses the brand of a credit card from its number.
+func cardBrand(number string) string {
+	n := strings.Replace(strings.Replace(number, " ", "", -1), "-", "", -1)
+	switch {
+	case strings.HasPrefix(n, "4"):
+		return "Visa"
+	case strings.HasPrefix(n, "34"), strings.HasPrefix(n, "37"):
+		return "Amex"
+	case strings.HasPrefix(n, "6011"), strings.HasPrefix(n, "65"):
+		return "Discover"
+	case len(n) > 1 && n[0] == '5' && n[1] >= '1' && n[1] <= '5':
+		return "Mastercard"
+	}
+	return ""
+}
+
+// writeBitwardenJSON writes the items as an unencrypted Bitwarden JSON export
+// to filename, creating a folder for each distinct item folder.
+//
+// Bitwarden nests a folder named "Archive/Deleted" in a folder "Archive" if
+// there is one, so every folder is named after its folderPath joined by "/",
+// and its parents are created as well.
+func writeBitwardenJSON(filename string, items []bitwardenItem) error {
+	export := bitwardenExport{Folders: []bitwardenFolder{}, Items: []bitwardenItem{}}
+	folders := map[string]string{}
+	folderID := func(name string) string {
+		id, ok := folders[name]
+		if !ok {
+			id = newUUID()
+			folders[name] = id
+			export.Folders = append(export.Folders, bitwardenFolder{ID: id, Name: name})
+		}
+		return id
+	}
+	for _, item := range items {
+		path := folderPath(item.folder)
+		for i := range path {
+			id := folderID(strings.Join(path[:i+1], "/"))
+			item.FolderID = &id
+		}
+		export.Items = append(export.Items, item)
+	}
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(export); err != nil {
+			return errors.Wrap(err, "json.Encode error")
+		}
+		return nil
+	})
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	chromeFile  string
+	firefoxFile string
+)
+
+func init() {
+	registerFormat("chrome", "Chrome and Edge password csv of the sites only, written to -chrome", newChromeExporter)
+	registerFormat("firefox", "Firefox password csv of the sites only, written to -firefox", newFirefoxExporter)
+
+	flag.StringVar(&chromeFile, "chrome", "chrome_passwords.csv", "Output path and filename for -format chrome.")
+	flag.StringVar(&firefoxFile, "firefox", "firefox_passwords.csv", "Output path and filename for -format firefox.")
+}
+
+// browserExporter writes the sites as a csv for a browser's built-in
+// password manager.  Browsers only store logins, so every card that is not a
+// site is left out and listed when written.
+type browserExporter struct {
+	name     string
+	filename string
+	header   []string
+	row      func(e entry) interface{}
+
+	rows    []interface{}
+	omitted []string
+}
+
+func newChromeExporter() (Exporter, error) {
+	return &browserExporter{name: "chrome", filename: chromeFile, header: csvHeaders(chromeRow{}), row: chromeRowFor}, nil
+}
+
+func newFirefoxExporter() (Exporter, error) {
+	return &browserExporter{name: "firefox", filename: firefoxFile, header: csvHeaders(firefoxRow{}), row: firefoxRowFor}, nil
+}
+
+// chromeRow is a single row of a Chrome or Edge password csv.
+type chromeRow struct {
+	Name     string `csv:"name"`
+	URL      string `csv:"url"`
+	Username string `csv:"username"`
+	Password string `csv:"password"`
+	Note     string `csv:"note"`
+}
+
+// firefoxRow is a single row of a Firefox password csv.
+type firefoxRow struct {
+	URL                 string `csv:"url"`
+	Username            string `csv:"username"`
+	Password            string `csv:"password"`
+	HTTPRealm           string `csv:"httpRealm"`
+	FormActionOrigin    string `csv:"formActionOrigin"`
+	GUID                string `csv:"guid"`
+	TimeCreated         string `csv:"timeCreated"`
+	TimeLastUsed        string `csv:"timeLastUsed"`
+	TimePasswordChanged string `csv:"timePasswordChanged"`
+}
+
+// Add converts every site to a row.  parse converts a card either to sites
+// only or to a single note, so a card is left out as a whole.
+func (x *browserExporter) Add(entries []entry) error {
+	var rows []interface{}
+	for _, e := range entries {
+		if e.Kind != entrySite {
+			logV(3, "not a site, leaving out of the browser csv", "card", e.CardID, "format", x.name)
+			x.omitted = append(x.omitted, e.CardID)
+			return nil
+		}
+		rows = append(rows, x.row(e))
+	}
+	x.rows = append(x.rows, rows...)
+	return nil
+}
+
+// Write writes all rows to the csv and logs a summary of the cards left
+// out.
+func (x *browserExporter) Write() error {
+	if len(x.omitted) > 0 {
+		logger.Warn("cards left out of the browser csv as they are not sites", "format", x.name, "omitted", len(x.omitted), "cards", strings.Join(x.omitted, ", "))
+	}
+	var rows [][]string
+	for _, r := range x.rows {
+		rows = append(rows, csvSlice(r))
+	}
+	// the csv is meant to be imported, so every cell is written verbatim.
+	return writeCSV(x.filename, x.header, rows, false)
+}
+
+// chromeRowFor converts a site to a Chrome row.  The fields not used by the
+// login are kept in the note.
+func chromeRowFor(e entry) interface{} {
+	return chromeRow{
+		Name:     e.Title,
+		URL:      e.URL,
+		Username: e.Username,
+		Password: e.Password,
+		Note:     siteNotes(e),
+	}
+}
+
+// firefoxRowFor converts a site to a Firefox row.  Firefox has nowhere to
+// keep anything but the login itself.
+func firefoxRowFor(e entry) interface{} {
+	origin := siteOrigin(e.URL)
+	// SafeInCloud only keeps the last modification of a card.
+	modified := strconv.FormatInt(modifiedTime(e).UnixNano()/int64(time.Millisecond), 10)
+	return firefoxRow{
+		URL:                 origin,
+		Username:            e.Username,
+		Password:            e.Password,
+		FormActionOrigin:    origin,
+		GUID:                "{" + newUUID() + "}",
+		TimeCreated:         modified,
+		TimeLastUsed:        modified,
+		TimePasswordChanged: modified,
+	}
+}
+
+// siteOrigin returns the scheme and host of a website, which is all Firefox
+// keeps of it.  Websites without a scheme are assumed to be https.
+func siteOrigin(website string) string {
+	if !strings.Contains(website, "://") {
+		website = "https://" + website
+	}
+	u, err := url.Parse(website)
+	if err != nil || u.Host == "" {
+		return website
+	}
+	return u.Scheme + "://" + u.Host
+}
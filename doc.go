@@ -33,7 +33,9 @@ https://github.com/eduncan911/sic2lp/releases
 
 Or, you can install from source:
 
-    go install github.com/eduncan911/sic2lp
+    go install github.com/eduncan911/sic2lp@latest
+
+Building from source requires Go 1.22 or later.
 
 How to Use
 
@@ -44,34 +46,511 @@ as possibly an attachments/ folder that holds any secure attachments you had.
     $ sic2lp -h
     Usage of sic2lp:
       sic2lp -db /path/to/SafeInCloud_Export.xml [options]
+      sic2lp -vault vault.json [options]
+      sic2lp lint -db /path/to/SafeInCloud_Export.xml [options]
+      sic2lp dump -db /path/to/SafeInCloud_Export.xml -o vault.json [options]
+      sic2lp reverse -csv lastpass_export.csv -o SafeInCloud.xml
+      sic2lp rewrite -db /path/to/SafeInCloud_Export.xml -rules rename.yaml -o fixed.xml
+      sic2lp templates -db /path/to/SafeInCloud_Export.xml -o templates.json
 
     Examples:
-      sic2lp -db SafeInCloud_2017-03-19.xml -p "Credit Cards,Banking,Insurance" -logtostderr -v 5
+      sic2lp -db SafeInCloud_2017-03-19.xml -p "Credit Cards,Banking,Insurance" -v 5
       sic2lp -db SafeInCloud_2017-03-19.xml -d "Untagged" -p "Credit Cards,Banking,Insurance"
-      sic2lp -db SafeInCloud_2017-03-19.xml -d "Imported (SafeInCloud)" -logtostderr -v 5
-      sic2lp -db SafeInCloud_2017-03-19.xml -p "Accounting,Software,Inventor" -logtostderr -v 3
+      sic2lp -db SafeInCloud_2017-03-19.xml -d "Imported (SafeInCloud)" -v 5
+      sic2lp -db SafeInCloud_2017-03-19.xml -p "Accounting,Software,Inventor" -v 3
+      sic2lp -vault vault.json -format lastpass,kdbx -kdbx-password-file master.txt
 
     Available flags:
+      -1password-csv string
+            Output path and filename for -format 1password. (default "1password.csv")
+      -1pux string
+            Output path and filename for -format 1pux. (default "sic2lp.1pux")
+      -attachments-dedup
+            Extract identical attachments only once, see attachments/manifest.json for the cards sharing them. (default true)
+      -attachments-exclude-ext string
+            Do not extract attachments with one of these extensions (comma delimited).
+      -attachments-exclude-label string
+            Do not extract the attachments of cards with one of these labels (comma delimited).
+      -attachments-include-ext string
+            Only extract attachments with one of these extensions (comma delimited).
+      -attachments-include-label string
+            Only extract the attachments of cards with one of these labels (comma delimited).
+      -attachments-max-size int
+            Do not extract attachments larger than this many bytes (0 extracts any size).
+      -attachments-per-card
+            Extract the attachments of each card into its own subdirectory of attachments/.
+      -attachments-skip-images
+            Do not extract image attachments.
+      -attachments-zip
+            Package the attachments of each card into a single zip in attachments/.
+      -bitwarden string
+            Output path and filename for -format bitwarden. (default "bitwarden.json")
+      -chrome string
+            Output path and filename for -format chrome. (default "chrome_passwords.csv")
       -db string
-            An Exported SafeInCloud.xml path and filename.
+            An Exported SafeInCloud.xml, or the encrypted SafeInCloud.db, path and filename.
+      -deleted string
+            What to do with deleted cards: skip, or archive as Secure Notes in -deleted-folder. (default "skip")
+      -deleted-folder string
+            Folder of the deleted cards archived by -deleted archive. (default "Archive\\Deleted in SafeInCloud")
+      -exclude-label string
+            Never convert cards with one of these labels (comma delimited), overrides every other filter.
       -f string
             Default folder of unlabelled cards. (default "Imported")
+      -firefox string
+            Output path and filename for -format firefox. (default "firefox_passwords.csv")
+      -format string
+            Output formats to write (comma delimited), see Available formats. (default "lastpass")
+      -ids string
+            Only convert the cards with these SafeInCloud IDs (comma delimited).
+      -include-label string
+            Only convert cards with one of these labels (comma delimited).
+      -inline-text-attachments int
+            Inline UTF-8 text attachments up to this many bytes into the extra instead of extracting them (0 never inlines).
+      -kdbx string
+            Output path and filename for -format kdbx. (default "sic2lp.kdbx")
+      -kdbx-cipher string
+            Cipher for -format kdbx: aes or chacha20. (default "aes")
+      -kdbx-password-file string
+            File whose first line is the master password for -format kdbx.
+      -keep-going
+            Skip cards that fail to convert and report them at the end instead of aborting.
+      -log-format string
+            Log format written to stderr: text or json. (default "text")
+      -logtostderr
+            Deprecated: logs are always written to stderr.
+      -metadata
+            Add the SafeInCloud ID, last modification, color and icon of every card to the extra.
       -p string
             Priority folder of labels to assign in order (comma delimited).
-
-    Logging Options:
-      -logtostderr
-            log to standard error instead of files
-      -v value
-            log level for V logs
+      -pass-dir string
+            Output directory of the password-store tree for -format pass. (default "password-store")
+      -pass-gpg string
+            The gpg binary used to encrypt for -format pass. (default "gpg")
+      -pass-plaintext
+            Write -format pass as unencrypted .txt files instead, which pass cannot read, to encrypt some other way.
+      -pass-recipients string
+            GPG key IDs to encrypt to for -format pass (comma delimited), required unless -pass-plaintext.
+      -password-fd int
+            Read the master password of an encrypted SafeInCloud .db from this file descriptor instead of prompting. (default -1)
+      -review
+            Also write review-only csvs with passwords masked (never import these).
+      -safe-csv
+            Also write spreadsheet-safe copies of the csvs, with cells starting with =, +, - or @ neutralized (never import these).
+      -since-state string
+            Only convert the cards new or changed since the run that wrote this -state file, and list the removed ones in removed_cards.csv.
+      -sort string
+            Order of the cards in every output: db (as in SafeInCloud) or modified (most recently modified first). (default "db")
+      -starred-only
+            Only convert starred cards.
+      -state string
+            Write the content hash of every converted card to this file, for -since-state of a later run.
+      -templates string
+            Template definitions written by the templates subcommand, to map the cards created from a template to its NoteType.
+      -title-regex string
+            Only convert cards whose title matches this regular expression.
+      -v int
+            Log level for verbose logs (3 or 5).
+      -vault string
+            A vault JSON written by the dump subcommand to convert instead of -db.
+
+    Available formats:
+      bitwarden  Bitwarden unencrypted JSON export, written to -bitwarden
+      chrome     Chrome and Edge password csv of the sites only, written to -chrome
+      firefox    Firefox password csv of the sites only, written to -firefox
+      kdbx       KeePass KDBX 4 database with attachments, written to -kdbx
+      lastpass   LastPass csvs: lastpass_sites.csv and lastpass_notes.csv, attachments in attachments/
+      1password  1Password csv of the logins only, written to -1password-csv
+      1pux       1Password 1PUX archive with every card and attachment, written to -1pux
+      pass       password-store (pass) tree, written to -pass-dir and encrypted with -pass-recipients
 
 See below for tips on how to prepare your SafeInCloud for the best possible import.
 
+Instead of an XML export, "-db" also accepts SafeInCloud's own encrypted
+database file (SafeInCloud.db, found in your SafeInCloud cloud folder or
+backups).  It is decrypted in memory with your master password, so no
+plaintext copy of your passwords is ever written to disk.  The password is
+prompted for on the terminal without echo, or read from a file descriptor
+with "-password-fd" for scripts:
+
+    $ sic2lp -db SafeInCloud.db -p "Google,Banking"
+    SafeInCloud master password:
+    $ sic2lp -db SafeInCloud.db -password-fd 3 3< <(pass show safeincloud)
+
+The lint and dump subcommands accept the encrypted database the same way.
+
+Output Formats
+
+LastPass csvs are written by default.  Use "-format" to select one or more
+other formats instead, for example "-format lastpass,kdbx" to write both the
+LastPass csvs and a KeePass database from the same run.  The SafeInCloud cards
+are classified into sites and notes only once, so every format agrees on what
+is a login and which folder it goes into.
+
+By default, any card that fails to convert (for example, an attachment that
+cannot be written to disk) aborts the whole run.  With "-keep-going" the failed
+card is left out of the format it failed for, and any of its attachments
+already extracted are removed again.  The rest of the cards are converted and
+written, and the tool exits with a non-zero status after printing the ID,
+format and cause of every card that failed.  Fix those cards and convert them
+again.  With "-state", only the formats a card was written to are recorded, so
+that "-since-state" converts it again for the others, see below.
+
+All csvs and attachments are written to a temporary file first and only renamed
+into place once completely written to disk.  If the run is interrupted with
+Ctrl-C, every output written so far is removed again so that a half finished
+run is never mistaken for a complete one.  A csv that would be empty is not
+written at all, and any csv of the same name left over from a previous run is
+removed.
+
+Converting a Subset
+
+Every card that is not deleted or a template is converted, unless filtered:
+
+    -ids            only the cards with these SafeInCloud IDs
+    -include-label  only cards with at least one of these labels
+    -starred-only   only starred cards
+    -title-regex    only cards whose title matches the regular expression
+    -exclude-label  never cards with any of these labels
+
+Filters combine: a card is only converted if it passes every filter given, and
+"-exclude-label" wins over all others, even over a card listed in "-ids".
+Labels are compared ignoring case.  For example, to migrate the shared work
+cards to the team's vault and everything else to your own:
+
+    $ sic2lp -db SafeInCloud.xml -include-label Work -exclude-label Personal
+    $ sic2lp -db SafeInCloud.xml -exclude-label Work
+
+The cards left out are counted as "filtered" in the totals logged at the end,
+and logged one by one with "-v 3".  The dump subcommand takes the same
+filters, and they also apply to a vault read with "-vault".
+
+Deleted Cards
+
+Cards in SafeInCloud's trash are skipped, but the trash often holds old
+credentials that turn out to be needed later.  With "-deleted archive" they
+are converted as well, each as a plain Secure Note in the folder
+"Archive\Deleted in SafeInCloud" (see "-deleted-folder"), whatever they were
+before.  All of their fields and notes are kept, and their original labels are
+noted at the end of the extra as for every other card.  Deleted templates are
+skipped either way, as templates are never converted.
+
+Card Metadata
+
+SafeInCloud remembers when every card was last modified, and its color and
+icon, which helps to tell stale credentials from recent ones.  With
+"-metadata" they are added to the extra of every LastPass entry, after the
+notes:
+
+    SafeInCloud ID: 42
+    Last Modified: 2017-03-19 16:53:51 UTC
+    Color: blue
+    Icon: bank
+
+"-sort modified" writes the most recently modified cards first, in every
+format, instead of in the order of the SafeInCloud database.  The modification
+time is also listed for every attachment in attachments/manifest.json and the
+index, and is the creation and modification time of every 1PUX item and
+Firefox login.
+
+Converting Again
+
+If you keep using SafeInCloud while moving over, you will export more than
+once.  Importing every card again would duplicate everything already
+migrated, so record the state of each run with "-state", and only convert
+what changed since with "-since-state":
+
+    $ sic2lp -db SafeInCloud_2017-03-19.xml -state state.json
+    $ sic2lp -db SafeInCloud_2017-04-02.xml -since-state state.json -state state.json
+
+The state holds a SHA-256 of every converted card, of everything it is
+converted to including its attachments, folder and metadata.  With
+"-since-state" only new cards and cards whose hash changed are written, and
+the unchanged ones are counted as "unchanged" in the totals.  A changed card
+is imported as a new entry, so a warning names the old entry to delete.  Cards
+in the earlier state that are gone from the export, deleted or otherwise, are
+logged and listed in removed_cards.csv to delete by hand.
+
+The state also records the formats every card was written to, as "written".
+An unchanged card is still converted for every format of the run it was not
+written to, and only for those: a format it failed for with "-keep-going", or
+a format added to "-format" since.  Cards that are filtered out keep their
+earlier state, if any, so they are converted again by the next run.  Note that
+changing "-p", "-f" or the filters changes the folders of the cards, and with
+them their hashes.
+
+Attachments
+
+LastPass csvs cannot hold attachments, so "-format lastpass" extracts them to
+attachments/ to be attached by hand.  Every file is named after the ID and
+title of its card and its position on the card, for example
+"42_Bank of Foo_0_statement.pdf" or "42_Bank of Foo_1.jpg" for an image, so
+that the names are the same on every run and two cards of the same title never
+overwrite each other.  With "-attachments-per-card" each card gets its own
+directory instead, as in "42_Bank of Foo/0_statement.pdf".  Should two names
+still collide, for example because they only differ in case, the later one is
+numbered and a warning is logged.
+
+The type of every attachment is detected from its content rather than trusted
+from its name.  SafeInCloud does not keep the names of images, so an image is
+named ".png", ".gif" and so on by what it actually is, and only ".jpg" if it is
+a JPEG or cannot be told.  The same goes for the images embedded by the
+KeePass, 1Password, pass and vault formats, as "image_0.png" and so on.  A
+file without an extension gets the extension of its content, and a file whose
+extension contradicts its content, such as a "statement.pdf" that is really a
+PNG, gets the right extension added ("0_statement.pdf.png") and a warning is
+logged.
+
+Identical attachments, such as the same scan attached to several cards, are
+only extracted once.  attachments/manifest.json lists every attachment of
+every card, its size, detected MIME type and SHA-256, and the file that holds
+it, with "deduplicated" set where that file was extracted for an earlier card.
+Use "-attachments-dedup=false" to extract a copy for every card.
+
+Small text attachments, such as recovery codes, SSH public keys or license
+keys, are easily forgotten in a directory.  With "-inline-text-attachments
+4096" every attachment of up to 4096 bytes that is UTF-8 text is added to the
+extra of its LastPass entry instead, after the notes:
+
+    ----- Attachment: recovery-codes.txt -----
+    1234-5678
+    8765-4321
+    ----- End of recovery-codes.txt -----
+
+Images, binary files and larger files are still extracted, and the manifest
+lists the inlined ones with "inlined" set.
+
+With thousands of scanned images, not every attachment may be worth
+migrating.  "-attachments-skip-images" leaves out all images,
+"-attachments-max-size" everything larger than the given number of bytes,
+"-attachments-include-ext" and "-attachments-exclude-ext" select by extension
+(for example "pdf,txt"), and "-attachments-include-label" and
+"-attachments-exclude-label" select the cards by their SafeInCloud labels.
+Skipped attachments are logged and listed in the manifest with the reason in
+"skipped".  "-attachments-zip" packages the attachments of every card into a
+single "42_Bank of Foo.zip", to attach just one file per entry.
+
+To attach the files by hand after importing into LastPass, open
+attachments/index.html in a browser, or attachments/index.csv in a
+spreadsheet.  Both list every attachment by the LastPass folder and entry
+name it belongs to, the SafeInCloud card ID, the file holding it, its size and
+type, sorted by folder and name, with a column of checkboxes to tick off each
+file once it is attached.
+
+Bitwarden
+
+Use "-format bitwarden" to write an unencrypted Bitwarden JSON export to
+bitwarden.json (see "-bitwarden" to change it), which can be imported at Bitwarden as "Bitwarden (json)".  Cards are
+classified the same way as for LastPass: every complete login becomes a Login
+item with its username, password, website and TOTP (a field of type one time
+password).  Cards that are not sites become Secure Notes, except for cards in
+the "Credit Cards" folder that become Card items and cards in the "Passport"
+folder that become Identity items.
+
+Every remaining SafeInCloud field is kept as a custom field (hidden for
+passwords, pins and secrets), the folder is chosen exactly as for LastPass
+("Parent\Child" folders become nested folders), and starred cards become
+favorites.  Delete the file once imported - it holds all
+of your passwords in the clear.
+
+KeePass
+
+Use "-format kdbx -kdbx-password-file master.txt" to write a KeePass KDBX 4
+database to sic2lp.kdbx (see "-kdbx" to change it), protected with the password
+on the first line of master.txt.
+The key is derived with Argon2, and the database is encrypted with AES-256 or,
+with "-kdbx-cipher chacha20", ChaCha20.  It opens with KeePass 2.35+, KeePassXC
+and most other KeePass compatible apps.
+
+Unlike the LastPass csvs, nothing is lost:
+
+* Labels become a tree of groups ("Parent\Child" labels become nested groups), and each entry is placed in the group of the label that picked its folder: a card in "Imported - Google" for LastPass is in the "Google" group below "Imported"
+* All labels of a card are kept as the entry's tags
+* Every field is kept as a custom string field, protected for passwords, pins and secrets
+* Files and images are embedded as native attachments, stored once for all entries of a card
+* A one time password field becomes the KeePassXC "otp" attribute
+
+Exporting to 1Password
+
+Use "-format 1pux" to write a 1Password Unencrypted Export to sic2lp.1pux (see
+"-1pux" to change it), which 1Password 8 imports with everything intact.  Sites
+become Login items, and notes in the "Credit Cards", "Banking", "Passport" and
+"Servers" folders become Credit Card, Bank Account, Passport and Server items
+with the fields named as LastPass expects (see Card Fields below) filled in.
+Everything else becomes a Secure Note.  Every label of a card becomes a tag, as
+1Password has no folders, and all files and images are included in the archive,
+attached to the item of the card's first login only.
+
+Use "-format 1password" to write only the logins to 1password.csv (see
+"-1password-csv" to change it) instead.  1Password imports every csv row as a
+Login, so notes are left out of the csv and counted in the log.
+
+Browsers
+
+For shared logins of little value, "-format chrome" writes
+chrome_passwords.csv for the built-in password manager of Chrome and Edge, and
+"-format firefox" writes firefox_passwords.csv for Firefox (see "-chrome" and
+"-firefox" to change them).  Logins are paired exactly as for LastPass sites.
+Browsers only keep logins, so cards that are not sites are left out and listed
+in a warning at the end of the run.  Chrome keeps the remaining fields and
+notes in the note column; Firefox has no place for them at all.
+
+Password Store
+
+Use "-format pass -pass-recipients KEYID" to write a password-store tree for
+pass to the password-store/ directory (see "-pass-dir" to change it), and copy
+or merge it into ~/.password-store.  Every entry is encrypted to the
+comma delimited GPG recipients with the local gpg binary ("-pass-gpg" to use
+another one), and a .gpg-id file is written for them.
+
+Each folder becomes a directory ("Parent\Child" folders are nested), with one
+file per note named after its title, and one file per login named
+title/login.  The password is on the first line, followed by "login:", "url:",
+an otpauth:// line for pass-otp and every other field as "key: value" lines,
+with the notes last.  The attachments of an entry are placed next to it in a
+title.attachments/ directory, encrypted as well.
+
+"-pass-recipients" is required, as pass cannot read anything else.  To write
+the tree unencrypted instead, as .txt files to be encrypted some other way,
+give "-pass-plaintext".
+
+Editing Between Parsing and Export
+
+Rather than editing the SafeInCloud XML or the LastPass csvs to fix a few
+cards, dump the converted cards to a JSON file, edit it by hand or with a
+script, and convert the JSON with any format:
+
+    $ sic2lp dump -db SafeInCloud_Export.xml -p "Google,Banking" -o vault.json
+    $ sic2lp -vault vault.json -format lastpass,bitwarden
+
+The cards are dumped after they have been classified and assigned a folder,
+so "-p" and "-f" are given to dump and have no effect with "-vault".  Deleted
+cards, unless given "-deleted archive", and templates are left out.
+Attachments are inlined as base64, or with "-attachments files" written to
+vault_files/ next to vault.json and referenced by their relative path.  Give
+dump "-templates" as well to keep the NoteTypes of cards created from
+templates, see Templates below.
+
+The JSON is versioned; a newer version than the tool understands is refused:
+
+    {
+      "version": 4,
+      "cards": [
+        {
+          "id": "10",
+          "entries": [
+            {
+              "card_id": "10",
+              "kind": "site",
+              "title": "Google",
+              "folder": "Google",
+              "labels": ["Google", "Personal"],
+              "favorite": true,
+              "note_type": "",
+              "username": "bob@example.com",
+              "password": "secret",
+              "url": "https://accounts.google.com",
+              "otp": "",
+              "modified": "2017-03-19T16:53:51Z",
+              "color": "blue",
+              "symbol": "web",
+              "fields": [
+                {"name": "Login", "type": "login", "value": "bob@example.com", "role": "login"}
+              ],
+              "notes": "",
+              "attachments": [
+                {"name": "codes.txt", "image": false, "data": "base64...", "path": ""}
+              ]
+            }
+          ]
+        }
+      ]
+    }
+
+Each card holds one entry per login, and is always converted as a whole.  An
+entry's "kind" is either "site" (with username, password and url) or "note",
+and "note_type" is the LastPass Secure Note type of a note.  "fields" are all
+SafeInCloud fields in order with their SafeInCloud type, and "role" is set to
+login, password, website or otp on the fields used for those.  "modified",
+"color" and "symbol" are the card's metadata, see "Card Metadata", and
+"template" the ID of the template it was created from if the export records
+it.  "deleted" is set on the deleted cards archived with "-deleted archive".
+Empty values may be left out.  An attachment has either "data" or "path".  The
+entries of a card share its attachments, so they are only written to its first
+entry: any other entry without attachments of its own gets the same.
+
+Going Back to SafeInCloud
+
+The reverse subcommand converts a LastPass csv export back into an XML file
+that SafeInCloud can import:
+
+    $ sic2lp reverse -csv lastpass_export.csv -o SafeInCloud.xml
+
+Sites become cards with Login, Password and Website fields (and a one time
+password field if LastPass exported a TOTP secret), with the extra as notes.
+Secure Notes with a NoteType have their "Key:Value" lines turned back into
+fields, typed by name where possible, and a label for the NoteType (such as
+"Credit Cards") is added.  Every grouping becomes a label, and the "Labels:"
+line sic2lp adds to the extra is turned back into labels.  Attachments are not
+part of LastPass csv exports and cannot be restored.
+
+Logging
+
+Logs are only ever written to stderr; nothing is written to the system's temp
+directory.  Use "-v 3" or "-v 5" for more detail on why cards are converted the
+way they are, and "-log-format json" for machine readable logs.  Every
+subcommand takes both flags as well, as in "sic2lp dump -v 5 ...".
+
+Logs will contain card IDs, labels, folders and field names.  They will never
+contain a field's value: logins, passwords, websites, notes and so on are
+redacted even if they are accidentally passed to the logger.  Titles are left
+out too, as a card without one is titled after its website, and so are the
+paths of the attachments and other files named after them, so look cards up
+by their ID and attachments by their position on the card.  This applies to
+every subcommand.
+
+Reviewing the CSVs
+
+It is tempting to open lastpass_sites.csv in Excel or LibreOffice to look it
+over before importing.  Be careful: any value starting with =, +, - or @ (very
+common in generated passwords) is treated as a formula by spreadsheets.
+
+Use the "-review" flag to also write lastpass_sites_review.csv and
+lastpass_notes_review.csv.  These copies mask every password, pin and secret
+field while keeping everything else visible, and are always neutralized for
+spreadsheets.  They are for reviewing only - never import them.
+
+If you really need the full csvs in a spreadsheet, the "-safe-csv" flag also
+writes lastpass_sites_safe.csv and lastpass_notes_safe.csv, with any such cell
+prefixed with a single quote.  LastPass does not strip that quote on import,
+so never import these copies either: the csvs to import are always written
+verbatim.
+
 Preparation
 
 Below is a list of recommendations to prepare your SafeInCloud database for the
 best possible import.
 
+Start by running the lint subcommand against your export with the same "-p"
+and "-f" flags you intend to convert with:
+
+    $ sic2lp lint -db SafeInCloud_2017-03-19.xml -p "Google,Banking"
+    11 "Google": [secure-note] will be a Secure Note: login "Login" has no field of type password after it
+    12 "Chase": [note-field] field "Routing" is not a "Bank Account" field and will only be in the notes; expected one of: ...
+    15 "Multi": [multi-login] logins "Login A" and "Login B" are both paired with password "Password A"
+    [label] label "Personal" is not covered by -p; 4 card(s) will be imported into "Imported - Personal"
+
+It reports cards that look like logins, with a password or website, but will
+degrade to Secure Notes and why.  Cards whose folder has a NoteType, such as
+"Credit Cards", are meant to be Secure Notes and are not reported as such.  It
+also reports fields whose name does not match their type (such as a "Password"
+stored as text, or a "PIN" that is not of type pin), labels not covered by
+"-p", field names that do not match the target NoteType, and cards with
+multiple logins that are ambiguously paired.  Add "-json" for machine readable
+output.  Lint exits with 1 if anything was found.
+
+The rest of this section explains each of these in detail.
+
 * Sites
 
 Note that all SafeInCloud cards are 'tested' to see if they are a "Site", and if so
@@ -199,32 +678,93 @@ Note: SafeInCloud's "Template" feature is only good for creating new cards, not
 renaming fields of existing cards.  I know, that would have been much easier if it
 did follow a relational model.
 
+Instead, the rewrite subcommand renames and retypes fields, and renames,
+merges or removes labels, on every card at once.  Write the rules in a YAML
+file:
+
+    rename:
+      - from: Routing
+        to: Routing Number
+        label: Banking      # optional, only cards with this label
+    retype:
+      - field: PIN
+        from: text          # optional, only fields of this type
+        to: password
+    relabel:
+      - from: Bank
+        to: Banking         # merged if Banking exists, removed if empty
+
+Then write a fixed copy of your export and import it back into SafeInCloud, or
+convert it right away:
+
+    $ sic2lp rewrite -db SafeInCloud_2017-03-19.xml -rules rename.yaml -o fixed.xml
+
+Field names and labels are matched ignoring case, and every rule that matches
+nothing is reported.  Everything else in the XML is written back unchanged.
+
+* Templates
+
+Templates themselves are never converted, but the field layout you built in
+them is not thrown away.  The templates subcommand writes a definition of every
+template, its fields and their types, and the LastPass NoteType and field
+names they most likely map to, and prints a report of them with the number of
+cards created from each:
+
+    $ sic2lp templates -db SafeInCloud_2017-03-19.xml -o templates.json
+    14 "Bank Account": NoteType "Bank Account", 12 card(s) created from it
+      Account Number (number): LastPass field "Account Number"
+      Routing (number): kept in the notes
+    1 template(s)
+
+The NoteType is guessed from the template's title or labels, and a field is
+only mapped if it is named like a field of that NoteType.  Correct
+"note_type" and "lastpass_field" in templates.json by hand, for example set
+"lastpass_field" of Routing to "Routing Number", and convert with it:
+
+    $ sic2lp -db SafeInCloud_2017-03-19.xml -templates templates.json
+
+The dump subcommand takes "-templates" the same way, so that a vault converted
+with "-vault" keeps the mapping.
+
+Every Secure Note that has all the fields of a template is taken to be created
+from it, the template with the most fields winning, and gets the template's
+NoteType, overriding the one of its label, and its fields renamed to their
+LastPass field names.  Most exports do not record the template of a card, so a
+card whose template fields were removed or renamed is not matched.  A card
+whose <card> element does name its template, with a "template_id" attribute,
+is matched to that template only, whatever its fields.  Deleted cards archived
+with "-deleted archive" are never matched, and stay plain Secure Notes.
+
 Customization
 
 You can modify the behavior by editing the source code and running the tool
-on your location machine.  All source is located in a single file to make it
-easy for newcomers (not my typical code arrangement; but, it is easy to
-follow).
+on your location machine.  The conversion logic is located in main.go to make
+it easy for newcomers (not my typical code arrangement; but, it is easy to
+follow).  Each output format lives in its own file next to it, such as
+lastpass.go, and implements the small Exporter interface found in exporter.go.
+To add a new format, add a new file that calls registerFormat in its init
+function - there is no need to touch the parsing logic.  Supporting plumbing,
+such as how output files are written, lives in its own file as well.
 
 1 - Download and install GoLang: https://golang.org/dl/
 
-2 - Checkout the sourcecode with GoLang:
+2 - Checkout the sourcecode with git, anywhere you like as it is a Go module:
 
-    go get github.com/eduncan911/sic2lp.git
+    git clone https://github.com/eduncan911/sic2lp.git
 
 3 - Change directory and open the main.go script with your favorite editor:
 
-    cd $HOME/go/src/github.com/eduncan911/sic2lp
+    cd sic2lp
     open main.go
 
-    cd %USERPROFILE%\go\src\github.com\eduncan911\sic2lp
+    cd sic2lp
     notepad main.go
 
 4 - Modify the source as needed.
 
 5 - Run the code with your changes:
 
-    go run main.go -db <SafeInCloud_Export.xml> -p "Label1,Label2" -logtostderr -v 5
+    go run . -db <SafeInCloud_Export.xml> -p "Label1,Label2" -v 5
 
 This is a verbose output command to help with debugging.
 
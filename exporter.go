@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the kinds of entry a card is converted to, see parse.
+const (
+	entrySite = "site" // has a login, password and website
+	entryNote = "note" // everything else
+)
+
+// the roles of the fields used by a site's login.
+const (
+	roleLogin    = "login"
+	rolePassword = "password"
+	roleWebsite  = "website"
+	roleOTP      = "otp"
+)
+
+// entry is a SafeInCloud card converted into a format-neutral representation
+// that every Exporter receives.  A card with multiple logins is converted to
+// multiple entries, one per login.
+//
+// It is also the schema of the intermediate JSON written by the dump
+// subcommand, see vault.go.  Changing it means bumping vaultVersion.
+type entry struct {
+	CardID   string   `json:"card_id"`
+	Kind     string   `json:"kind"`
+	Title    string   `json:"title"`
+	Folder   string   `json:"folder"`
+	Labels   []string `json:"labels,omitempty"`
+	Favorite bool     `json:"favorite,omitempty"`
+
+	// Deleted is set if the card was deleted in SafeInCloud, and archived
+	// with "-deleted archive".
+	Deleted bool `json:"deleted,omitempty"`
+
+	// NoteType is the LastPass Secure Note type picked from the folder, if
+	// any.  Other formats use it to pick a specialized item type as well.
+	NoteType string `json:"note_type,omitempty"`
+
+	// Username, Password and URL are only set for sites.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	URL      string `json:"url,omitempty"`
+
+	// OTP is the value of the first one time password field, if any.
+	OTP string `json:"otp,omitempty"`
+
+	// Modified is when the card was last changed in SafeInCloud, in RFC 3339,
+	// and Color and Symbol are its color and icon there, if known.
+	Modified string `json:"modified,omitempty"`
+	Color    string `json:"color,omitempty"`
+	Symbol   string `json:"symbol,omitempty"`
+
+	// Template is the ID of the template the card was created from, if the
+	// export records it.
+	Template string `json:"template,omitempty"`
+
+	// Fields holds every field of the card in order, including those used
+	// above, which are marked with their Role.
+	Fields      []entryField `json:"fields,omitempty"`
+	Notes       string       `json:"notes,omitempty"`
+	Attachments []attachment `json:"attachments,omitempty"`
+}
+
+// entryField is a single SafeInCloud field.
+type entryField struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+
+	// Role is set if the field was used for the login, password, website or
+	// OTP of the entry.
+	Role string `json:"role,omitempty"`
+}
+
+// attachment is a file or image attached to a card.
+type attachment struct {
+	// Name is the file name as stored in SafeInCloud.  It is always empty
+	// for images, which SafeInCloud stores without a name, and which are named
+	// after their sniffed content type instead, see imageFilename.
+	Name  string `json:"name,omitempty"`
+	Image bool   `json:"image,omitempty"`
+
+	// Data is the content, base64 encoded in JSON.  When dumped with
+	// "-attachments files", Data is omitted and Path refers to the file
+	// relative to the JSON file instead.
+	Data []byte `json:"data,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// Exporter writes converted cards in a single output format.
+//
+// Add is called once per card with all of the entries the card was converted
+// to, in the order of the cards in the SafeInCloud database.  It must either
+// add all of them or, when returning an error, none at all.  Write is called
+// once after all cards have been added.
+type Exporter interface {
+	Add(entries []entry) error
+	Write() error
+}
+
+// exporterFormat is an output format that can be selected with "-format".
+type exporterFormat struct {
+	name        string
+	description string
+	new         func() (Exporter, error)
+}
+
+// formats are all of the registered output formats, in registration order.
+var formats []exporterFormat
+
+// registerFormat registers an output format under name.  new is called after
+// the flags have been parsed, so that it can validate the format's flags.
+//
+// Formats register themselves, and their own flags, in an init function.
+func registerFormat(name, description string, new func() (Exporter, error)) {
+	formats = append(formats, exporterFormat{name: name, description: description, new: new})
+}
+
+// namedExporter is an Exporter selected with "-format".
+type namedExporter struct {
+	name string
+	Exporter
+}
+
+// newExporters returns the exporters for the comma delimited format names.
+func newExporters(names string) ([]namedExporter, error) {
+	var exporters []namedExporter
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, ok := findFormat(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown format %q", name)
+		}
+		x, err := f.new()
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		exporters = append(exporters, namedExporter{name: f.name, Exporter: x})
+	}
+	if len(exporters) == 0 {
+		return nil, errors.New("no format selected")
+	}
+	return exporters, nil
+}
+
+// findFormat returns the registered format called name.
+func findFormat(name string) (exporterFormat, bool) {
+	for _, f := range formats {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return exporterFormat{}, false
+}
+
+// siteNotes returns the notes of a site preceded by every field not used by
+// its login, for formats that have no custom fields.
+func siteNotes(e entry) string {
+	var notes string
+	for _, f := range e.Fields {
+		if f.Role != "" || f.Value == "" {
+			continue
+		}
+		notes = notes + fmt.Sprintf(extraFormat, f.Name, f.Value)
+	}
+	return strings.TrimSpace(notes + e.Notes)
+}
+
+// folderPath splits a folder into the names of its nested folders.  Folders
+// nest on "\" as at LastPass, or on "/" as everywhere else, for example the
+// "-deleted-folder" default of `Archive\Deleted in SafeInCloud`.
+func folderPath(folder string) []string {
+	var parts []string
+	for _, p := range strings.Split(strings.Replace(folder, "\\", "/", -1), "/") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// cardFilter selects a subset of the cards to convert, for example to
+// migrate a shared work subset separately from personal cards.
+//
+// A card is only converted if it passes every filter that is set: it is one
+// of ids, has one of includeLabels, is starred and its title matches
+// titleRegex.  A card with one of excludeLabels is never converted, even if
+// it is listed in ids.
+type cardFilter struct {
+	idsRaw           string
+	includeLabelsRaw string
+	excludeLabelsRaw string
+	starredOnly      bool
+	titleRegexRaw    string
+
+	ids           []string
+	includeLabels []string
+	excludeLabels []string
+	titleRegex    *regexp.Regexp
+}
+
+// filterFlags registers the card filter flags with fs, for every command that
+// converts cards, and returns the filter they set.
+func filterFlags(fs *flag.FlagSet) *cardFilter {
+	f := &cardFilter{}
+	fs.StringVar(&f.idsRaw, "ids", "", "Only convert the cards with these SafeInCloud IDs (comma delimited).")
+	fs.StringVar(&f.includeLabelsRaw, "include-label", "", "Only convert cards with one of these labels (comma delimited).")
+	fs.StringVar(&f.excludeLabelsRaw, "exclude-label", "", "Never convert cards with one of these labels (comma delimited), overrides every other filter.")
+	fs.BoolVar(&f.starredOnly, "starred-only", false, "Only convert starred cards.")
+	fs.StringVar(&f.titleRegexRaw, "title-regex", "", "Only convert cards whose title matches this regular expression.")
+	return f
+}
+
+// compile parses the flags of the filter, and must be called before match.
+func (f *cardFilter) compile() error {
+	f.ids = splitList(f.idsRaw)
+	f.includeLabels = splitList(f.includeLabelsRaw)
+	f.excludeLabels = splitList(f.excludeLabelsRaw)
+	if f.titleRegexRaw != "" {
+		re, err := regexp.Compile(f.titleRegexRaw)
+		if err != nil {
+			return errors.Wrap(err, "-title-regex")
+		}
+		f.titleRegex = re
+	}
+	return nil
+}
+
+// match returns "" if the card of the entry passes the filter, or else the
+// name of the filter it failed.
+func (f *cardFilter) match(e entry) string {
+	switch {
+	case hasLabel(e.Labels, f.excludeLabels):
+		return "exclude-label"
+	case len(f.ids) > 0 && !containsString(f.ids, e.CardID):
+		return "ids"
+	case len(f.includeLabels) > 0 && !hasLabel(e.Labels, f.includeLabels):
+		return "include-label"
+	case f.starredOnly && !e.Favorite:
+		return "starred-only"
+	case f.titleRegex != nil && !f.titleRegex.MatchString(e.Title):
+		return "title-regex"
+	}
+	return ""
+}
+
+// apply returns the cards that pass the filter, in order, and the number of
+// cards filtered out.
+func (f *cardFilter) apply(cards [][]entry) ([][]entry, int) {
+	var kept [][]entry
+	var filtered int
+	for _, entries := range cards {
+		c := entries[0]
+		if name := f.match(c); name != "" {
+			logV(3, "card filtered out", "card", c.CardID, "filter", name)
+			filtered++
+			continue
+		}
+		kept = append(kept, entries)
+	}
+	return kept, filtered
+}
@@ -0,0 +1,22 @@
+module github.com/eduncan911/sic2lp
+
+go 1.22.0
+
+// TODO: github.com/eduncan911/safeincloud, imported by every command, is not
+// required yet as its version could not be resolved when this file was
+// written.  Pin it with:
+//
+//	go get github.com/eduncan911/safeincloud@latest && go mod tidy
+
+require (
+	github.com/pkg/errors v0.9.1
+	github.com/tobischo/gokeepasslib/v3 v3.6.0
+	golang.org/x/crypto v0.22.0
+	golang.org/x/term v0.19.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/tobischo/argon2 v0.1.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
+)
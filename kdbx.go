@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tobischo/gokeepasslib/v3"
+	"github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+var (
+	kdbxFile         string
+	kdbxPasswordFile string
+	kdbxCipher       string
+)
+
+func init() {
+	registerFormat("kdbx", "KeePass KDBX 4 database with attachments, written to -kdbx", newKDBXExporter)
+
+	flag.StringVar(&kdbxFile, "kdbx", "sic2lp.kdbx", "Output path and filename for -format kdbx.")
+	flag.StringVar(&kdbxPasswordFile, "kdbx-password-file", "", "File whose first line is the master password for -format kdbx.")
+	flag.StringVar(&kdbxCipher, "kdbx-cipher", "aes", "Cipher for -format kdbx: aes or chacha20.")
+}
+
+// kdbxExporter writes a password protected KeePass KDBX 4 database.
+type kdbxExporter struct {
+	password string
+	cards    []kdbxCard
+}
+
+// newKDBXExporter reads the master password up front so that a missing
+// password fails the run before anything is converted.
+func newKDBXExporter() (Exporter, error) {
+	if kdbxCipher != "aes" && kdbxCipher != "chacha20" {
+		return nil, errors.Errorf("unknown -kdbx-cipher %q, must be aes or chacha20", kdbxCipher)
+	}
+	if kdbxPasswordFile == "" {
+		return nil, errors.New("a master password is required in -kdbx-password-file")
+	}
+	pw, err := readPasswordFile(kdbxPasswordFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "a master password is required in -kdbx-password-file")
+	}
+	return &kdbxExporter{password: pw}, nil
+}
+
+// Add converts every entry to a KeePass entry.
+//
+// Every field not mapped to a standard KeePass field is kept as a custom
+// string field, protected in memory for secrets.
+func (x *kdbxExporter) Add(entries []entry) error {
+	// every entry of a card has the same attachments.
+	c := kdbxCard{attachments: kdbxAttachments(entries[0])}
+	for _, e := range entries {
+		k := kdbxEntry{group: kdbxGroupPath(e), tags: e.Labels}
+		k.values = append(k.values, kdbxValue("Title", e.Title, false))
+		if e.Kind == entrySite {
+			k.values = append(k.values,
+				kdbxValue("UserName", e.Username, false),
+				kdbxValue("Password", e.Password, true),
+				kdbxValue("URL", e.URL, false),
+			)
+		}
+		if e.Notes != "" {
+			k.values = append(k.values, kdbxValue("Notes", e.Notes, false))
+		}
+		if e.OTP != "" {
+			k.values = append(k.values, kdbxValue("otp", otpauthURI(e.OTP, e.Title, e.Username), true))
+		}
+		k.values = append(k.values, kdbxFields(e)...)
+		c.entries = append(c.entries, k)
+	}
+	x.cards = append(x.cards, c)
+	return nil
+}
+
+// Write writes all cards to kdbxFile.
+func (x *kdbxExporter) Write() error {
+	return writeKDBX(kdbxFile, x.password, kdbxCipher, x.cards)
+}
+
+// kdbxCard is a card converted for KeePass: an entry per login, and the
+// attachments they all share.
+type kdbxCard struct {
+	entries     []kdbxEntry
+	attachments []kdbxAttachment
+}
+
+// kdbxEntry is an entry converted for KeePass, waiting to be placed into its
+// group when the database is written.
+type kdbxEntry struct {
+	group  []string
+	tags   []string
+	values []gokeepasslib.ValueData
+}
+
+// kdbxAttachment is a file or image to embed into the database.
+type kdbxAttachment struct {
+	name string
+	data []byte
+}
+
+// kdbxStandardFields are the KeePass entry fields that custom fields must not
+// collide with.
+var kdbxStandardFields = []string{"Title", "UserName", "Password", "URL", "Notes", "otp"}
+
+// kdbxFields returns every field not already used by the entry as custom
+// fields.
+func kdbxFields(e entry) []gokeepasslib.ValueData {
+	var values []gokeepasslib.ValueData
+
+	// KeePass keys are unique per entry, so rename duplicates.
+	taken := map[string]bool{}
+	for _, k := range kdbxStandardFields {
+		taken[k] = true
+	}
+	for _, f := range e.Fields {
+		if f.Role != "" {
+			continue
+		}
+		name := f.Name
+		for n := 2; taken[name] || name == ""; n++ {
+			name = f.Name + " (" + strconv.Itoa(n) + ")"
+		}
+		taken[name] = true
+		values = append(values, kdbxValue(name, f.Value, isSecretType(f.Type)))
+	}
+	return values
+}
+
+// kdbxAttachments returns the entry's files and images to embed.
+func kdbxAttachments(e entry) []kdbxAttachment {
+	var attachments []kdbxAttachment
+	var images int
+	for _, a := range e.Attachments {
+		name := a.Name
+		if a.Image {
+			name = imageFilename(images, a.Data)
+			images++
+		}
+		attachments = append(attachments, kdbxAttachment{name: name, data: a.Data})
+	}
+	return attachments
+}
+
+// kdbxGroupPath returns the path of the group the entry is placed in, which
+// maps its labels to a group tree: each label is a group, nested on "\" or
+// "/", and the entry goes into the group of the label that picked its folder.
+//
+// A card with no label in "-p" is in the "Default - Label" folder for
+// LastPass, and in the group of the label below the default folder's group
+// for KeePass.  Folders that are not a label, such as the default folder and
+// the "-deleted-folder", nest the same way.
+func kdbxGroupPath(e entry) []string {
+	for _, l := range e.Labels {
+		if strings.EqualFold(e.Folder, l) {
+			return folderPath(l)
+		}
+	}
+	if len(e.Labels) > 0 && strings.HasSuffix(e.Folder, " - "+e.Labels[0]) {
+		df := strings.TrimSuffix(e.Folder, " - "+e.Labels[0])
+		return append(folderPath(df), folderPath(e.Labels[0])...)
+	}
+	return folderPath(e.Folder)
+}
+
+// otpauthURI returns the otpauth:// URI KeePassXC expects in the "otp"
+// attribute.  SafeInCloud stores either such a URI already, or the bare
+// base32 secret.
+func otpauthURI(v, title, login string) string {
+	if strings.HasPrefix(strings.ToLower(v), "otpauth://") {
+		return v
+	}
+	label := title
+	if login != "" {
+		label = title + ":" + login
+	}
+	q := url.Values{}
+	q.Set("secret", strings.Replace(strings.ToUpper(v), " ", "", -1))
+	q.Set("issuer", title)
+	return "otpauth://totp/" + url.PathEscape(label) + "?" + q.Encode()
+}
+
+// kdbxValue returns a KeePass string field, protected in memory if set.
+func kdbxValue(key, value string, protected bool) gokeepasslib.ValueData {
+	v := gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: value}}
+	if protected {
+		v.Value.Protected = wrappers.NewBoolWrapper(true)
+	}
+	return v
+}
+
+// readPasswordFile returns the first line of filename, without the line
+// ending, to be used as a master password.
+func readPasswordFile(filename string) (string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", errors.Wrap(err, "ioutil.ReadFile error")
+	}
+	pw := strings.SplitN(string(b), "\n", 2)[0]
+	pw = strings.TrimSuffix(pw, "\r")
+	if pw == "" {
+		return "", errors.New("password file is empty")
+	}
+	return pw, nil
+}
+
+// writeKDBX writes the entries to a password protected KeePass KDBX 4
+// database at filename.
+//
+// KDBX 4 uses Argon2 to derive the key from the password, and cipher selects
+// either "aes" (AES-256) or "chacha20" (ChaCha20) to encrypt the database.
+// Every entry is placed into its group below the root group, see
+// kdbxGroupPath, and keeps all labels of its card as tags.
+func writeKDBX(filename, password, cipher string, cards []kdbxCard) error {
+	kdb := gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion4())
+	switch cipher {
+	case "aes":
+		// the KDBX 4 defaults are for ChaCha20, whose IV is 12 bytes; AES-CBC
+		// needs one of a whole block.
+		iv := make([]byte, 16)
+		if _, err := rand.Read(iv); err != nil {
+			return errors.Wrap(err, "rand.Read error")
+		}
+		kdb.Header.FileHeaders.CipherID = gokeepasslib.CipherAES
+		kdb.Header.FileHeaders.EncryptionIV = iv
+	case "chacha20":
+		kdb.Header.FileHeaders.CipherID = gokeepasslib.CipherChaCha20
+	default:
+		return errors.Errorf("unknown cipher %q, must be aes or chacha20", cipher)
+	}
+	kdb.Credentials = gokeepasslib.NewPasswordCredentials(password)
+
+	root := &kdbxGroup{name: "SafeInCloud"}
+	for _, c := range cards {
+		// stored once in the binary pool, and referenced by every entry of
+		// the card.
+		var binaries []*gokeepasslib.Binary
+		for _, a := range c.attachments {
+			binaries = append(binaries, kdb.AddBinary(a.data))
+		}
+		for _, e := range c.entries {
+			entry := gokeepasslib.NewEntry()
+			entry.Values = e.values
+			entry.Tags = strings.Join(e.tags, ";")
+			for i, b := range binaries {
+				entry.Binaries = append(entry.Binaries, b.CreateReference(c.attachments[i].name))
+			}
+			g := root.child(e.group)
+			g.entries = append(g.entries, entry)
+		}
+	}
+	kdb.Content.Root = &gokeepasslib.RootData{
+		Groups: []gokeepasslib.Group{root.group()},
+	}
+	if err := kdb.LockProtectedEntries(); err != nil {
+		return errors.Wrap(err, "LockProtectedEntries error")
+	}
+
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		if err := gokeepasslib.NewEncoder(w).Encode(kdb); err != nil {
+			return errors.Wrap(err, "kdbx Encode error")
+		}
+		return nil
+	})
+}
+
+// kdbxGroup builds the group tree before it is converted to gokeepasslib
+// groups, which are stored by value.
+type kdbxGroup struct {
+	name    string
+	entries []gokeepasslib.Entry
+	groups  []*kdbxGroup
+}
+
+// child returns the group at path below g, creating it as needed.
+func (g *kdbxGroup) child(path []string) *kdbxGroup {
+	cur := g
+	for _, name := range path {
+		var next *kdbxGroup
+		for _, sub := range cur.groups {
+			if sub.name == name {
+				next = sub
+				break
+			}
+		}
+		if next == nil {
+			next = &kdbxGroup{name: name}
+			cur.groups = append(cur.groups, next)
+		}
+		cur = next
+	}
+	return cur
+}
+
+// group converts g and its children to a gokeepasslib.Group.
+func (g *kdbxGroup) group() gokeepasslib.Group {
+	group := gokeepasslib.NewGroup()
+	group.Name = g.name
+	group.Entries = g.entries
+	for _, sub := range g.groups {
+		group.Groups = append(group.Groups, sub.group())
+	}
+	return group
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	safeCSV            bool
+	reviewCSV          bool
+	attachmentsPerCard bool
+	attachmentsDedup   bool
+	inlineAttachments  int
+	lastpassMetadata   bool
+
+	attachmentsZip           bool
+	attachmentsSkipImages    bool
+	attachmentsMaxSize       int
+	attachmentsIncludeExts   string
+	attachmentsExcludeExts   string
+	attachmentsIncludeLabels string
+	attachmentsExcludeLabels string
+
+	extraFormat = `%s: %s
+
+`
+	maskedValue = "********"
+)
+
+func init() {
+	registerFormat("lastpass", "LastPass csvs: lastpass_sites.csv and lastpass_notes.csv, attachments in attachments/", newLastPassExporter)
+
+	flag.BoolVar(&safeCSV, "safe-csv", false, "Also write spreadsheet-safe copies of the csvs, with cells starting with =, +, - or @ neutralized (never import these).")
+	flag.BoolVar(&reviewCSV, "review", false, "Also write review-only csvs with passwords masked (never import these).")
+	flag.BoolVar(&attachmentsPerCard, "attachments-per-card", false, "Extract the attachments of each card into its own subdirectory of attachments/.")
+	flag.BoolVar(&attachmentsDedup, "attachments-dedup", true, "Extract identical attachments only once, see attachments/manifest.json for the cards sharing them.")
+	flag.BoolVar(&lastpassMetadata, "metadata", false, "Add the SafeInCloud ID, last modification, color and icon of every card to the extra.")
+	flag.IntVar(&inlineAttachments, "inline-text-attachments", 0, "Inline UTF-8 text attachments up to this many bytes into the extra instead of extracting them (0 never inlines).")
+	flag.BoolVar(&attachmentsZip, "attachments-zip", false, "Package the attachments of each card into a single zip in attachments/.")
+	flag.BoolVar(&attachmentsSkipImages, "attachments-skip-images", false, "Do not extract image attachments.")
+	flag.IntVar(&attachmentsMaxSize, "attachments-max-size", 0, "Do not extract attachments larger than this many bytes (0 extracts any size).")
+	flag.StringVar(&attachmentsIncludeExts, "attachments-include-ext", "", "Only extract attachments with one of these extensions (comma delimited).")
+	flag.StringVar(&attachmentsExcludeExts, "attachments-exclude-ext", "", "Do not extract attachments with one of these extensions (comma delimited).")
+	flag.StringVar(&attachmentsIncludeLabels, "attachments-include-label", "", "Only extract the attachments of cards with one of these labels (comma delimited).")
+	flag.StringVar(&attachmentsExcludeLabels, "attachments-exclude-label", "", "Do not extract the attachments of cards with one of these labels (comma delimited).")
+}
+
+// lastpassExporter writes the LastPass csvs, and dumps all attachments to disk
+// as LastPass csv imports do not support them.
+type lastpassExporter struct {
+	sites       []site
+	notes       []note
+	attachments *attachmentStore
+}
+
+func newLastPassExporter() (Exporter, error) {
+	return &lastpassExporter{
+		attachments: newAttachmentStore("attachments", attachmentOptions{
+			PerCard:   attachmentsPerCard,
+			Dedup:     attachmentsDedup,
+			InlineMax: inlineAttachments,
+			Zip:       attachmentsZip,
+
+			SkipImages:    attachmentsSkipImages,
+			MaxSize:       attachmentsMaxSize,
+			IncludeExts:   splitExts(attachmentsIncludeExts),
+			ExcludeExts:   splitExts(attachmentsExcludeExts),
+			IncludeLabels: splitList(attachmentsIncludeLabels),
+			ExcludeLabels: splitList(attachmentsExcludeLabels),
+		}),
+	}, nil
+}
+
+// Add converts every entry to a LastPass site or Secure Note, and dumps the
+// card's attachments for manual imports.  Inlined text attachments, and the
+// metadata with "-metadata", are added to the notes of every entry.
+func (x *lastpassExporter) Add(entries []entry) error {
+	// every entry of a card has the same attachments.
+	inlined, err := x.attachments.extract(entries[0])
+	if err != nil {
+		return errors.Wrap(err, "extract attachments returned error")
+	}
+
+	var sites []site
+	var notes []note
+	for _, e := range entries {
+		if inlined != "" {
+			e.Notes = strings.TrimSpace(e.Notes + "\n\n" + inlined)
+		}
+		if lastpassMetadata {
+			e.Notes = strings.TrimSpace(e.Notes + "\n\n" + metadataBlock(e))
+		}
+		switch e.Kind {
+		case entrySite:
+			s, err := importSite(e)
+			if err != nil {
+				return errors.Wrap(err, "importSite returned error")
+			}
+			sites = append(sites, s)
+		default:
+			n, err := importSecureNote(e)
+			if err != nil {
+				return errors.Wrap(err, "importSecureNote returned error")
+			}
+			notes = append(notes, n)
+		}
+	}
+	x.sites = append(x.sites, sites...)
+	x.notes = append(x.notes, notes...)
+	return nil
+}
+
+// Write exports all to csvs.
+func (x *lastpassExporter) Write() error {
+	// the csvs to import are always written verbatim, as LastPass would
+	// import the quote of a neutralized cell as part of the value.
+	if err := writeSitesCSV("lastpass_sites.csv", x.sites, false); err != nil {
+		return errors.Wrap(err, "writeSitesCSV error")
+	}
+	if err := writeSecureNotesCSV("lastpass_notes.csv", x.notes, false); err != nil {
+		return errors.Wrap(err, "writeSecureNotesCSV error")
+	}
+
+	// copies are never meant to be imported; always neutralize them.
+	if safeCSV {
+		if err := writeSitesCSV("lastpass_sites_safe.csv", x.sites, true); err != nil {
+			return errors.Wrap(err, "writeSitesCSV safe error")
+		}
+		if err := writeSecureNotesCSV("lastpass_notes_safe.csv", x.notes, true); err != nil {
+			return errors.Wrap(err, "writeSecureNotesCSV safe error")
+		}
+	}
+	if reviewCSV {
+		if err := writeSitesCSV("lastpass_sites_review.csv", reviewSites(x.sites), true); err != nil {
+			return errors.Wrap(err, "writeSitesCSV review error")
+		}
+		if err := writeSecureNotesCSV("lastpass_notes_review.csv", reviewNotes(x.notes), true); err != nil {
+			return errors.Wrap(err, "writeSecureNotesCSV review error")
+		}
+	}
+	if err := x.attachments.write(); err != nil {
+		return errors.Wrap(err, "attachments write error")
+	}
+	return nil
+}
+
+// site defines a LastPass site to import.
+//
+// Sites require all of the following at a minimal: URL, Username, Password, Name.
+type site struct {
+	URL      string `csv:"url"`
+	Type     string `csv:"type"`
+	Username string `csv:"username"`
+	Password string `csv:"password"`
+	Hostname string `csv:"hostname"`
+	Extra    string `csv:"extra"`
+	Name     string `csv:"name"`
+	Grouping string `csv:"grouping"`
+	Fav      string `csv:"fav"` // ?
+
+	// reviewExtra is Extra with all secret field values masked.
+	reviewExtra string `csv:"-"`
+}
+
+// importSite assumes the entry has been validated as a site by parse.  It
+// will then generate a LastPass site for it.
+func importSite(e entry) (site, error) {
+	s := site{
+		Name:     e.Title,
+		URL:      e.URL,
+		Username: e.Username,
+		Password: e.Password,
+	}
+	if e.Favorite {
+		logV(5, "found favorite", "card", e.CardID)
+		s.Fav = "1"
+	}
+	s.Grouping = e.Folder
+	logger.Info("importing Website", "card", e.CardID, "folder", s.Grouping)
+
+	// build up the Extra section to comprise of the entire card.
+	for _, f := range e.Fields {
+		// we'll exclue what we already have above.
+		if f.Value == e.URL ||
+			f.Value == e.Username ||
+			f.Value == e.Password {
+			continue
+		}
+		s.Extra = s.Extra + fmt.Sprintf(extraFormat, f.Name, f.Value)
+		s.reviewExtra = s.reviewExtra + fmt.Sprintf(extraFormat, f.Name, reviewValue(f))
+	}
+	s.Extra = s.Extra + e.Notes
+	s.reviewExtra = s.reviewExtra + e.Notes
+
+	// add the original Labels this card was part of
+	labels := strings.Join(e.Labels, ", ")
+	if len(labels) > 0 {
+		s.Extra = s.Extra + `
+
+Labels: ` + labels
+		s.reviewExtra = s.reviewExtra + `
+
+Labels: ` + labels
+	}
+	return s, nil
+}
+
+// note defines a Secure Note at LastPass.
+//
+// * URL must be set to "http://sn" for all entries.
+// * Username and Password must be BLANK for all entries, except for Servers.
+type note struct {
+	URL      string `csv:"url"`
+	Username string `csv:"username"`
+	Password string `csv:"password"`
+	Extra    string `csv:"extra"`
+	Name     string `csv:"name"`
+	Grouping string `csv:"grouping"`
+	Fav      string `csv:"fav"`
+
+	// reviewExtra is Extra with all secret field values masked.
+	reviewExtra string `csv:"-"`
+}
+
+// importSecureNote assumes nothing.  It will attempt to take as much info
+// as possible from the entry and create a SecureNote for LastPass.
+func importSecureNote(e entry) (note, error) {
+	n := note{
+		URL:      "http://sn", // must be set to this
+		Name:     e.Title,
+		Username: "", // must be blank
+		Password: "", // must be blank
+	}
+	if e.Favorite {
+		logV(5, "found favorite", "card", e.CardID)
+		n.Fav = "1"
+	}
+	n.Grouping = e.Folder
+	logger.Info("importing Secure Note", "card", e.CardID, "folder", n.Grouping)
+
+	// build up the Extra section to comprise of the entire card.
+	//
+	// prefix with the expected NoteType, based on the Primary Grouping.
+	var prefix string
+	if e.NoteType != "" {
+		prefix = "NoteType:" + e.NoteType
+	}
+
+	if prefix != "" {
+		n.Extra = prefix + `
+
+` // LastPass expects a line break
+		n.reviewExtra = n.Extra
+	}
+
+	// NOTE: it's best to go back into SafeInCloud and massage each FieldName
+	// to match that of LastPass' expected field name.
+	//
+	// see their import format: https://helpdesk.lastpass.com/importing-from-other-password-managers/
+	//
+	// For example, for Credit Cards, you want to edit each card
+	// in SafeInCloud to change "Owner" to "Name on Card", "CVV" to "Security Code"
+	// and so on.
+	for _, f := range e.Fields {
+		n.Extra = n.Extra + fmt.Sprintf(extraFormat, f.Name, f.Value)
+		n.reviewExtra = n.reviewExtra + fmt.Sprintf(extraFormat, f.Name, reviewValue(f))
+	}
+	n.Extra = n.Extra + e.Notes
+	n.reviewExtra = n.reviewExtra + e.Notes
+
+	// add the original Labels this card was part of
+	labels := strings.Join(e.Labels, ", ")
+	if len(labels) > 0 {
+		n.Extra = n.Extra + `
+
+Labels: ` + labels
+		n.reviewExtra = n.reviewExtra + `
+
+Labels: ` + labels
+	}
+	return n, nil
+}
+
+// writeSitesCSV takes a list of sites and writes them to a csv, neutralized
+// with safeCell if safe is set.
+func writeSitesCSV(filename string, sites []site, safe bool) error {
+	var rows [][]string
+	for _, s := range sites {
+		rows = append(rows, csvSlice(s))
+	}
+	return writeCSV(filename, csvHeaders(site{}), rows, safe)
+}
+
+// writeSecureNotesCSV takes a list of notes and writes them to a csv,
+// neutralized with safeCell if safe is set.
+func writeSecureNotesCSV(filename string, notes []note, safe bool) error {
+	var rows [][]string
+	for _, n := range notes {
+		rows = append(rows, csvSlice(n))
+	}
+	return writeCSV(filename, csvHeaders(note{}), rows, safe)
+}
+
+// writeCSV writes the header and rows to a csv.  A csv without rows is not
+// written, and one left over from a previous run is removed.
+//
+// If safe is set, every cell is passed through safeCell so the csv can be
+// opened in a spreadsheet without evaluating formulas.  Never set it for a
+// csv to import.
+func writeCSV(filename string, header []string, rows [][]string, safe bool) error {
+	if len(rows) == 0 {
+		return removeStale(filename)
+	}
+	return writeFileAtomic(filename, func(f io.Writer) error {
+		w := csv.NewWriter(f)
+		if err := w.Write(header); err != nil {
+			return errors.Wrap(err, "writer.Write Headers error")
+		}
+		for _, row := range rows {
+			if safe {
+				neutralized := make([]string, len(row))
+				for i, cell := range row {
+					neutralized[i] = safeCell(cell)
+				}
+				row = neutralized
+			}
+			if err := w.Write(row); err != nil {
+				return errors.Wrap(err, "writer.Write Entry error")
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return errors.Wrap(err, "writer.Flush error")
+		}
+		return nil
+	})
+}
+
+// reviewSites returns a copy of sites suitable for a human to review: the
+// password is masked and the Extra section has all secret fields masked.
+func reviewSites(sites []site) []site {
+	var results []site
+	for _, s := range sites {
+		s.Password = maskedValue
+		s.Extra = s.reviewExtra
+		results = append(results, s)
+	}
+	return results
+}
+
+// reviewNotes returns a copy of notes suitable for a human to review with
+// all secret fields masked in the Extra section.
+func reviewNotes(notes []note) []note {
+	var results []note
+	for _, n := range notes {
+		n.Extra = n.reviewExtra
+		results = append(results, n)
+	}
+	return results
+}
+
+// reviewValue returns the value of the field to show in a review copy,
+// masking any field SafeInCloud considers a secret.
+func reviewValue(f entryField) string {
+	if isSecretType(f.Type) && f.Value != "" {
+		return maskedValue
+	}
+	return f.Value
+}
+
+// safeCell neutralizes a csv cell that a spreadsheet would evaluate as a
+// formula by prefixing it with a single quote.
+//
+// Note that LastPass does not strip the quote on import, so this is only
+// for copies opened in Excel, LibreOffice, Google Sheets, etc. and never for
+// a csv to import.
+func safeCell(v string) string {
+	if v == "" {
+		return v
+	}
+	switch v[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + v
+	}
+	return v
+}
+
+// csvHeaders evaluates a struct's tags and returns the csv headers.
+func csvHeaders(v interface{}) []string {
+	var results []string
+	value := reflect.ValueOf(v)
+	for i := 0; i < value.NumField(); i++ {
+		t := value.Type().Field(i).Tag
+		if t.Get("csv") == "-" {
+			continue
+		}
+		results = append(results, t.Get("csv"))
+	}
+	return results
+}
+
+// csvSlice evaluates a struct's fields and returns its values as strings.
+func csvSlice(v interface{}) []string {
+	var results []string
+	value := reflect.ValueOf(v)
+	for i := 0; i < value.NumField(); i++ {
+		if value.Type().Field(i).Tag.Get("csv") == "-" {
+			continue
+		}
+		results = append(results, value.Field(i).String())
+	}
+	return results
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/eduncan911/safeincloud"
+)
+
+// lintFinding is a single problem found by the lint subcommand.
+//
+// Findings never contain field values, only card IDs, titles, labels and
+// field names and types.
+type lintFinding struct {
+	Card    string `json:"card,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// the checks a lintFinding can come from.
+const (
+	lintSecureNote = "secure-note" // card will degrade to a Secure Note
+	lintFieldType  = "field-type"  // field name does not match its type
+	lintLabel      = "label"       // label is not covered by -p
+	lintNoteField  = "note-field"  // field name does not match the NoteType
+	lintMultiLogin = "multi-login" // logins are ambiguously paired
+)
+
+// fieldTypeHints maps lower cased field names to the SafeInCloud field type
+// a field with that name most likely should have been.
+var fieldTypeHints = map[string]string{
+	"login":     "login",
+	"username":  "login",
+	"user name": "login",
+	"user":      "login",
+	"password":  "password",
+	"pass":      "password",
+	"passwd":    "password",
+	"pwd":       "password",
+	"website":   "website",
+	"url":       "website",
+	"site":      "website",
+	"web site":  "website",
+	"pin":       "pin",
+}
+
+// runLint runs the "lint" subcommand with args and returns the exit code.
+//
+// Lint reports everything that will keep a card from converting the way the
+// user most likely expects, so that it can be fixed in SafeInCloud first.
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	var db, pfRaw, df string
+	var asJSON bool
+	fs.StringVar(&db, "db", "", "An Exported SafeInCloud.xml, or the encrypted SafeInCloud.db, path and filename.")
+	fs.StringVar(&df, "f", "Imported", "Default folder of unlabelled cards.")
+	fs.StringVar(&pfRaw, "p", "", "Priority folder of labels to assign in order (comma delimited).")
+	fs.BoolVar(&asJSON, "json", false, "Write the findings to stdout as JSON.")
+	passwordFlag(fs)
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s lint:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s lint -db /path/to/SafeInCloud_Export.xml [options]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "\nAvailable flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if db == "" {
+		fs.Usage()
+		return 0
+	}
+	var pf []string
+	if pfRaw != "" {
+		pf = strings.Split(pfRaw, ",")
+	}
+
+	sic, err := parseDatabase(db)
+	if err != nil {
+		logger.Error("unable to parse SafeInCloud export", "err", err)
+		return 10
+	}
+
+	findings := lint(sic, pf, df)
+	if asJSON {
+		err = writeLintJSON(os.Stdout, findings)
+	} else {
+		err = writeLintText(os.Stdout, findings)
+	}
+	if err != nil {
+		logger.Error("unable to write findings", "err", err)
+		return 12
+	}
+	if len(findings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// lint checks every card that would be converted and returns the findings.
+func lint(db *safeincloud.Database, pf []string, df string) []lintFinding {
+	var findings []lintFinding
+	uncovered := map[string]int{}
+	for _, c := range db.Cards {
+		if c.Deleted || c.Template {
+			continue
+		}
+		findings = append(findings, lintFieldTypes(c)...)
+		findings = append(findings, lintMultiLogins(c)...)
+
+		if !isSite(c) {
+			findings = append(findings, lintSite(db, c, pf, df)...)
+			findings = append(findings, lintNoteFields(db, c, pf, df)...)
+		}
+
+		labels := cardLabels(db, c)
+		if len(labels) > 0 && primaryCardLabel(db, c, pf, df) == df+" - "+labels[0] {
+			uncovered[labels[0]]++
+		}
+	}
+
+	// labels that decided the folder of a card without being listed in -p.
+	var names []string
+	for l := range uncovered {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+	for _, l := range names {
+		findings = append(findings, lintFinding{
+			Check:   lintLabel,
+			Message: fmt.Sprintf("label %q is not covered by -p; %d card(s) will be imported into %q", l, uncovered[l], df+" - "+l),
+		})
+	}
+
+	// priority folders that match nothing are most likely typos.
+	for _, f := range pf {
+		var found bool
+		for _, l := range db.Labels {
+			if strings.EqualFold(f, l.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			findings = append(findings, lintFinding{
+				Check:   lintLabel,
+				Message: fmt.Sprintf("priority folder %q does not match any label", f),
+			})
+		}
+	}
+	return findings
+}
+
+// isSite returns true if parse converts the card to at least one site: one of
+// its logins is paired with both a password and a website.
+func isSite(c safeincloud.Card) bool {
+	for _, p := range loginPairs(c) {
+		if p.Password >= 0 && p.Website >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lintSite returns why a card that looks like a login, as it has a password
+// or website, will degrade to a Secure Note.  Cards whose folder makes them a
+// NoteType, such as "Credit Cards", are meant to be notes and never reported.
+func lintSite(db *safeincloud.Database, c safeincloud.Card, pf []string, df string) []lintFinding {
+	if noteType(primaryCardLabel(db, c, pf, df)) != "" {
+		return nil
+	}
+	var looksLikeLogin bool
+	for _, f := range c.Fields {
+		if (f.FieldType == "password" || f.FieldType == "website") && f.Value != "" {
+			looksLikeLogin = true
+			break
+		}
+	}
+	if !looksLikeLogin {
+		return nil
+	}
+
+	finding := func(msg string) lintFinding {
+		return lintFinding{Card: c.ID, Title: c.Title, Check: lintSecureNote, Message: msg}
+	}
+	pairs := loginPairs(c)
+	if len(pairs) == 0 {
+		return []lintFinding{finding("will be a Secure Note: no field of type login")}
+	}
+	var findings []lintFinding
+	for _, p := range pairs {
+		name := c.Fields[p.Login].Name
+		if p.Password < 0 {
+			findings = append(findings, finding(fmt.Sprintf("will be a Secure Note: login %q has no field of type password after it", name)))
+		}
+		if p.Website < 0 {
+			findings = append(findings, finding(fmt.Sprintf("will be a Secure Note: login %q has no field of type website after it", name)))
+		}
+	}
+	return findings
+}
+
+// lintFieldTypes reports fields whose name suggests a different field type
+// than the one they have, such as a "Password" stored as text.
+func lintFieldTypes(c safeincloud.Card) []lintFinding {
+	var findings []lintFinding
+	for _, f := range c.Fields {
+		want, ok := fieldTypeHints[strings.ToLower(strings.TrimSpace(f.Name))]
+		if !ok || f.Value == "" || f.FieldType == want {
+			continue
+		}
+		findings = append(findings, lintFinding{
+			Card:    c.ID,
+			Title:   c.Title,
+			Check:   lintFieldType,
+			Message: fmt.Sprintf("field %q is of type %q, most likely should be %q", f.Name, f.FieldType, want),
+		})
+	}
+	return findings
+}
+
+// lintMultiLogins reports cards with multiple logins that do not each have
+// their own password following them.
+func lintMultiLogins(c safeincloud.Card) []lintFinding {
+	pairs := loginPairs(c)
+	if len(pairs) < 2 {
+		return nil
+	}
+	var findings []lintFinding
+	finding := func(msg string) {
+		findings = append(findings, lintFinding{Card: c.ID, Title: c.Title, Check: lintMultiLogin, Message: msg})
+	}
+	// sharing a website between logins is fine, sharing a password is not.
+	passwords := map[int]string{}
+	for _, p := range pairs {
+		if p.Password < 0 {
+			continue
+		}
+		login := c.Fields[p.Login].Name
+		if other, ok := passwords[p.Password]; ok {
+			finding(fmt.Sprintf("logins %q and %q are both paired with password %q", other, login, c.Fields[p.Password].Name))
+		}
+		passwords[p.Password] = login
+	}
+	for i, f := range c.Fields {
+		if f.FieldType != "password" || f.Value == "" {
+			continue
+		}
+		if _, ok := passwords[i]; !ok {
+			finding(fmt.Sprintf("password %q is not paired with any login; move it after its login", f.Name))
+		}
+	}
+	return findings
+}
+
+// lintNoteFields reports fields of a Secure Note that do not match the field
+// names LastPass expects for the card's NoteType.
+func lintNoteFields(db *safeincloud.Database, c safeincloud.Card, pf []string, df string) []lintFinding {
+	t := noteType(primaryCardLabel(db, c, pf, df))
+	expected := noteTypeFields[t]
+	if len(expected) == 0 {
+		return nil
+	}
+	var findings []lintFinding
+	for _, f := range c.Fields {
+		if containsString(expected, f.Name) {
+			continue
+		}
+		msg := fmt.Sprintf("field %q is not a %q field and will only be in the notes; expected one of: %s", f.Name, t, strings.Join(expected, ", "))
+		for _, e := range expected {
+			if strings.EqualFold(f.Name, e) {
+				msg = fmt.Sprintf("field %q should be renamed to %q for NoteType %q", f.Name, e, t)
+				break
+			}
+		}
+		findings = append(findings, lintFinding{Card: c.ID, Title: c.Title, Check: lintNoteField, Message: msg})
+	}
+	return findings
+}
+
+// containsString returns true if s is in list.
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLintText writes the findings for humans, one per line.
+func writeLintText(w io.Writer, findings []lintFinding) error {
+	for _, f := range findings {
+		var err error
+		if f.Card != "" {
+			_, err = fmt.Fprintf(w, "%s %q: [%s] %s\n", f.Card, f.Title, f.Check, f.Message)
+		} else {
+			_, err = fmt.Fprintf(w, "[%s] %s\n", f.Check, f.Message)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d finding(s)\n", len(findings))
+	return err
+}
+
+// writeLintJSON writes the findings as a JSON array.
+func writeLintJSON(w io.Writer, findings []lintFinding) error {
+	if findings == nil {
+		findings = []lintFinding{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(findings)
+}
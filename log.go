@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/eduncan911/safeincloud"
+)
+
+// logger is the structured logger for the run.  It always logs to stderr and
+// is configured by setupLogging once the flags have been parsed.  Until then it
+// logs at the defaults, with the same redaction policy.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: replaceAttr}))
+
+var (
+	logVerbosity int
+	logFormat    string
+	logToStderr  bool // deprecated: kept so existing scripts still run
+)
+
+// redacted replaces any attribute value that must never be logged.
+const redacted = "[REDACTED]"
+
+// redactedKeys are attribute keys that, by name, hold a SafeInCloud field
+// value.  Their values are redacted by the handler no matter what was passed.
+//
+// Titles are among them: the title of a site without one is its website, so
+// cards are only ever logged by their ID.  So are paths, as the files written
+// for a card are named after its title.
+var redactedKeys = map[string]bool{
+	"title":    true,
+	"path":     true,
+	"value":    true,
+	"login":    true,
+	"username": true,
+	"password": true,
+	"secret":   true,
+	"pin":      true,
+	"website":  true,
+	"url":      true,
+	"notes":    true,
+}
+
+// logFlags registers "-v" and "-log-format" with fs, for the main command and
+// every subcommand.
+func logFlags(fs *flag.FlagSet) {
+	fs.IntVar(&logVerbosity, "v", 0, "Log level for verbose logs (3 or 5).")
+	fs.StringVar(&logFormat, "log-format", "text", "Log format written to stderr: text or json.")
+}
+
+// vLevel returns the slog level for the glog style verbosity n, as used by
+// the "-v" flag.  For example, vLevel(5) is only logged with "-v 5" or above.
+func vLevel(n int) slog.Level {
+	return slog.LevelInfo - slog.Level(n)
+}
+
+// logV logs msg at the glog style verbosity n.
+func logV(n int, msg string, args ...interface{}) {
+	logger.Log(context.Background(), vLevel(n), msg, args...)
+}
+
+// setupLogging configures the logger from the "-v" and "-log-format" flags.
+//
+// The redaction policy is enforced here: logs may contain card IDs, labels,
+// folders and field names and types, but never a field value or title.  Call
+// sites must not log values in the first place; as a safety net, the handler
+// redacts any attribute named like a value (see redactedKeys) and any
+// safeincloud.Card or safeincloud.Field that is passed in whole.
+func setupLogging() error {
+	opts := &slog.HandlerOptions{
+		Level:       vLevel(logVerbosity),
+		ReplaceAttr: replaceAttr,
+	}
+	switch strings.ToLower(logFormat) {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", logFormat)
+	}
+	return nil
+}
+
+// replaceAttr names the verbose levels after their "-v" value, applies the
+// redaction policy to every attribute and logs errors by their message only,
+// as the text handler would print the stack trace of a pkg/errors error.
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if l, ok := a.Value.Any().(slog.Level); ok && l < slog.LevelInfo {
+			a.Value = slog.StringValue(fmt.Sprintf("V%d", slog.LevelInfo-l))
+		}
+		return a
+	}
+	if redactedKeys[strings.ToLower(a.Key)] {
+		a.Value = slog.StringValue(redacted)
+		return a
+	}
+	if a.Value.Kind() == slog.KindAny {
+		switch v := a.Value.Any().(type) {
+		case error:
+			a.Value = slog.StringValue(v.Error())
+		case safeincloud.Card:
+			a.Value = slog.StringValue(v.ID)
+		case safeincloud.Field:
+			a.Value = slog.StringValue(v.Name + " (" + v.FieldType + ")")
+		case []safeincloud.Field:
+			a.Value = slog.StringValue(redacted)
+		}
+	}
+	return a
+}
@@ -1,86 +1,239 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/url"
 	"os"
-	"reflect"
-	"strconv"
 	"strings"
 
 	"github.com/eduncan911/safeincloud"
-	"github.com/golang/glog"
-	"github.com/pkg/errors"
 )
 
 var (
 	dbFile             string
+	vaultFile          string
 	defaultFolder      string
 	priorityFoldersRaw string
 	priorityFolders    []string
-
-	importedSites []site
-	importedNotes []note
-	extraFormat   = `%s: %s
-
-`
+	formatsRaw         string
+	keepGoing          bool
+	filter             *cardFilter
+	deletedOpts        *deletedOptions
+	templatesFile      string
+	sortOrder          string
+	stateFile          string
+	sinceStateFile     string
 )
 
 func main() {
+	// subcommands have their own flags, and set up logging from them
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "lint":
+			os.Exit(runLint(os.Args[2:]))
+		case "dump":
+			os.Exit(runDump(os.Args[2:]))
+		case "reverse":
+			os.Exit(runReverse(os.Args[2:]))
+		case "rewrite":
+			os.Exit(runRewrite(os.Args[2:]))
+		case "templates":
+			os.Exit(runTemplates(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
-	if dbFile == "" {
+	if dbFile == "" && vaultFile == "" {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	exporters, err := newExporters(formatsRaw)
+	if err != nil {
+		logger.Error("unable to set up -format", "err", err)
+		os.Exit(2)
+	}
+	if err := filter.compile(); err != nil {
+		logger.Error("unable to set up filters", "err", err)
+		os.Exit(2)
+	}
+	archive, err := deletedOpts.archiveFolder()
+	if err != nil {
+		logger.Error("unable to set up -deleted", "err", err)
+		os.Exit(2)
+	}
+	if sortOrder != "db" && sortOrder != "modified" {
+		logger.Error("unknown -sort, must be db or modified", "sort", sortOrder)
+		os.Exit(2)
+	}
+	var templates []templateDef
+	if templatesFile != "" {
+		if templates, err = readTemplates(templatesFile); err != nil {
+			logger.Error("unable to read -templates", "err", err)
+			os.Exit(2)
+		}
+	}
+	var names []string
+	for _, x := range exporters {
+		names = append(names, x.name)
+	}
+	var prev map[string]stateCard
+	if sinceStateFile != "" {
+		if prev, err = readState(sinceStateFile, names); err != nil {
+			logger.Error("unable to read -since-state", "err", err)
+			os.Exit(2)
+		}
+	}
+	handleInterrupts()
 	if priorityFoldersRaw != "" {
 		priorityFolders = strings.Split(priorityFoldersRaw, ",")
 	}
 
-	// parse the SafeInCloud exported XML
-	db, err := safeincloud.ParseFile(dbFile)
-	if err != nil {
-		glog.Error(err)
-		os.Exit(10)
+	// parse the SafeInCloud exported XML, or a vault dumped from it earlier
+	var cards [][]entry
+	deleted, skipped := 0, 0
+	if vaultFile != "" {
+		if dbFile != "" {
+			logger.Error("-db and -vault cannot be used together")
+			os.Exit(2)
+		}
+		if cards, err = readVault(vaultFile); err != nil {
+			logger.Error("unable to read vault", "err", err)
+			os.Exit(10)
+		}
+	} else {
+		db, data, err := parseDatabaseXML(dbFile)
+		if err != nil {
+			logger.Error("unable to parse SafeInCloud export", "err", err)
+			os.Exit(10)
+		}
+		meta, err := readCardMeta(data)
+		if err != nil {
+			logger.Error("unable to parse SafeInCloud export", "err", err)
+			os.Exit(10)
+		}
+		cards, deleted, skipped = parseCards(db, priorityFolders, defaultFolder, archive)
+		applyMetadata(cards, meta)
+	}
+	applyTemplates(cards, templates)
+
+	// the state of this run starts as the earlier one, without the cards
+	// removed since, and is updated with every card converted.
+	var removed []stateCard
+	next := map[string]stateCard{}
+	if prev != nil {
+		removed = removedSince(cards, prev)
+		for id, c := range prev {
+			next[id] = c
+		}
+		for _, c := range removed {
+			logger.Warn("card removed since -since-state", "card", c.ID, "folder", c.Folder)
+			delete(next, c.ID)
+		}
 	}
-
-	// iterate over the SIC cards and parse
-	imported, deleted, skipped := 0, 0, 0
-	for _, c := range db.Cards {
-		if c.Deleted {
-			glog.Infoln("skipping deleted card", c.ID, c.Title)
-			deleted++
-			continue
+	cards, filtered := filter.apply(cards)
+	hashes := map[string]string{}
+	for _, entries := range cards {
+		h, err := cardHash(entries)
+		if err != nil {
+			logger.Error("unable to hash card", "card", entries[0].CardID, "err", err)
+			os.Exit(11)
 		}
-		if c.Template {
-			glog.Infoln("skipping template", c.ID, c.Title)
-			skipped++
-			continue
+		hashes[entries[0].CardID] = h
+	}
+	unchanged := 0
+	if prev != nil {
+		cards, unchanged = changedSince(cards, hashes, prev, names)
+	}
+	if sortOrder == "modified" {
+		sortByModified(cards)
+	}
+
+	// hand the entries of every card to every exporter, or only to those it
+	// was not written to yet if it is unchanged since -since-state.
+	imported := 0
+	var failed []cardError
+	for _, entries := range cards {
+		c := entries[0]
+		var written []string
+		p, same := prev[c.CardID]
+		if same = same && p.SHA256 == hashes[c.CardID]; same {
+			written = append(written, p.Written...)
+		}
+		ok := true
+		for _, x := range exporters {
+			if same && containsString(p.Written, x.name) {
+				continue
+			}
+			if err := x.Add(entries); err != nil {
+				if !keepGoing {
+					logger.Error("unable to convert card", "card", c.CardID, "format", x.name, "err", err)
+					os.Exit(11)
+				}
+				// exporters add all of a card or nothing, so the card is
+				// never half-migrated.
+				logger.Error("failed to convert card", "card", c.CardID, "format", x.name, "err", err)
+				failed = append(failed, cardError{ID: c.CardID, Format: x.name, Err: err})
+				ok = false
+				continue
+			}
+			written = append(written, x.name)
 		}
+		if ok {
+			imported++
+		}
+		// the card is in the state even if it failed, as it was written to
+		// the other formats, which would otherwise get it again next run.
+		next[c.CardID] = stateCard{ID: c.CardID, SHA256: hashes[c.CardID], Title: c.Title, Folder: c.Folder, Written: written}
+	}
 
-		if err := parse(db, c, priorityFolders, defaultFolder); err != nil {
-			glog.Errorln(err)
-			os.Exit(11)
+	for _, x := range exporters {
+		if err := x.Write(); err != nil {
+			logger.Error("unable to write output", "format", x.name, "err", err)
+			os.Exit(12)
 		}
-		imported++
 	}
 
-	// export all to csvs
-	if err := writeSitesCSV(importedSites); err != nil {
-		glog.Errorln("writeSitesCSV error:", err)
-		os.Exit(12)
+	if prev != nil {
+		if err := writeRemovedCSV(removedCardsCSV, removed); err != nil {
+			logger.Error("unable to write output", "file", removedCardsCSV, "err", err)
+			os.Exit(12)
+		}
 	}
-	if err := writeSecureNotesCSV(importedNotes); err != nil {
-		glog.Errorln("writeSitesCSV error:", err)
-		os.Exit(13)
+	if stateFile != "" {
+		if err := writeState(stateFile, next); err != nil {
+			logger.Error("unable to write -state", "err", err)
+			os.Exit(12)
+		}
 	}
 
-	glog.Infoln("Total Imported, Deleted, Skipped:", imported, deleted, skipped)
+	logger.Info("totals", "imported", imported, "deleted", deleted, "skipped", skipped, "filtered", filtered, "unchanged", unchanged, "removed", len(removed), "failed", len(failed))
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "%d card(s) failed to convert and were left out of their format:\n", len(failed))
+		for _, e := range failed {
+			fmt.Fprintln(os.Stderr, "  -", e)
+		}
+		os.Exit(11)
+	}
+}
+
+// cardError records why a single card failed to convert in -keep-going mode.
+// Like the logs, it names the card by its ID only.
+type cardError struct {
+	ID     string
+	Format string
+	Err    error
 }
 
-// parse determines the type of card to import.
+func (e cardError) Error() string {
+	return fmt.Sprintf("[%s] %s: %v", e.Format, e.ID, e.Err)
+}
+
+// parse determines the type of card to import and converts it into entries
+// for the exporters.
 //
 // to parse "sites" for LastPass, they require:
 //	- URL (sic Website type)
@@ -109,260 +262,168 @@ func main() {
 // correct order for the LP site to work properly with multiple logins like this.
 //
 // O == Opinionated Logic
-func parse(db *safeincloud.Database, c safeincloud.Card, pf []string, df string) error {
-	glog.V(5).Infoln(c.ID, c.Title, "being parsed.")
-	var importedSite bool
-	// loop the fields, looking for login, password and website SIC Types
-	for i, f := range c.Fields {
-
-		if f.FieldType == "login" && f.Value != "" {
-			glog.V(5).Infoln(c.ID, c.Title, "found login.")
-			login := f.Value
-
-			var pass, url string
-			for _, fi := range c.Fields[i:] {
-				if fi.FieldType == "password" && fi.Value != "" {
-					glog.V(5).Infoln(c.ID, c.Title, "found password.")
-					pass = fi.Value
-					break // break on the 1ST password found, don't keep loopin
-				}
-			}
-			for _, fi := range c.Fields[i:] {
-				if fi.FieldType == "website" && fi.Value != "" {
-					glog.V(5).Infoln(c.ID, c.Title, "found website.")
-					url = fi.Value
-					break // break on the 1ST website found, don't keep loopin
-				}
-			}
-
-			if pass == "" || url == "" {
-				glog.V(3).Infoln(c.ID, c.Title, "missing password or website value(s).")
-				continue
-			}
-
-			title := c.Title
-			if title == "" {
-				glog.V(5).Infoln(c.ID, c.Title, "title was empty, attemping to use website as title.")
-				title = url
-				title = strings.Replace(title, "http://", "", -1)
-				title = strings.Replace(title, "https://", "", -1)
-			}
-			if title == "" {
-				glog.V(3).Infoln(c.ID, c.Title, "missing title.")
-				continue
-			}
+func parse(db *safeincloud.Database, c safeincloud.Card, pf []string, df string) []entry {
+	logV(5, "being parsed", "card", c.ID)
+	var entries []entry
+	// loop the logins, each with the password and website paired to it
+	for _, p := range loginPairs(c) {
+		logV(5, "found login", "card", c.ID, "field", c.Fields[p.Login].Name)
+		if p.Password < 0 || p.Website < 0 {
+			logV(3, "missing password or website value(s)", "card", c.ID)
+			continue
+		}
+		logV(5, "found password", "card", c.ID, "field", c.Fields[p.Password].Name)
+		logV(5, "found website", "card", c.ID, "field", c.Fields[p.Website].Name)
 
-			// import as a LastPass site!
-			if err := importSite(db, c, pf, df, title, login, pass, url); err != nil {
-				return errors.Wrap(err, "importSite returned error")
-			}
-			importedSite = true
+		if c.Title == "" {
+			logV(5, "title was empty, attemping to use website as title", "card", c.ID)
 		}
+		title := siteTitle(c, c.Fields[p.Website].Value)
+		if title == "" {
+			logV(3, "missing title", "card", c.ID)
+			continue
+		}
+
+		// a LastPass site!
+		e := newEntry(db, c, pf, df, entrySite, title)
+		e.Username = c.Fields[p.Login].Value
+		e.Password = c.Fields[p.Password].Value
+		e.URL = c.Fields[p.Website].Value
+		e.Fields[p.Login].Role = roleLogin
+		e.Fields[p.Password].Role = rolePassword
+		e.Fields[p.Website].Role = roleWebsite
+		entries = append(entries, e)
 	}
-	if importedSite {
-		glog.V(5).Infoln(c.ID, c.Title, "has been imported as site.")
-		return nil
+	if len(entries) > 0 {
+		logV(5, "has been parsed as site", "card", c.ID)
+		return entries
 	}
 
-	// since we haven't imported anything, we'll treat it as a Secure Note
+	// since we haven't found a site, we'll treat it as a Secure Note
 	// going forward.
-	if err := importSecureNote(db, c, pf, df); err != nil {
-		return errors.Wrap(err, "importSecureNote returned error")
+	title := c.Title
+	if title == "" {
+		title = "SecureNote " + c.ID
 	}
-	return nil
+	e := newEntry(db, c, pf, df, entryNote, title)
+	e.NoteType = noteType(e.Folder)
+	return []entry{e}
 }
 
-// site defines a LastPass site to import.
-//
-// Sites require all of the following at a minimal: URL, Username, Password, Name.
-type site struct {
-	URL      string `csv:"url"`
-	Type     string `csv:"type"`
-	Username string `csv:"username"`
-	Password string `csv:"password"`
-	Hostname string `csv:"hostname"`
-	Extra    string `csv:"extra"`
-	Name     string `csv:"name"`
-	Grouping string `csv:"grouping"`
-	Fav      string `csv:"fav"` // ?
-}
-
-// importSite assumes the safeincloud.Card has been validated.  It will then
-// generate a card entry and store it in the global importedSites variable.
-func importSite(db *safeincloud.Database, c safeincloud.Card, pf []string, df, title, login, pass, url string) error {
-	s := site{
-		Name:     title,
-		URL:      url,
-		Username: login,
-		Password: pass,
-	}
-	if c.Star {
-		glog.V(5).Infoln(c.ID, title, "found favorite.")
-		s.Fav = "1"
+// newEntry returns an entry of kind with everything but the login filled in
+// from the card.
+func newEntry(db *safeincloud.Database, c safeincloud.Card, pf []string, df, kind, title string) entry {
+	e := entry{
+		CardID:   c.ID,
+		Kind:     kind,
+		Title:    title,
+		Folder:   primaryCardLabel(db, c, pf, df),
+		Labels:   cardLabels(db, c),
+		Favorite: c.Star,
+		Notes:    c.Notes,
 	}
-	s.Grouping = primaryCardLabel(db, c, pf, df)
-	glog.Infoln("importing Website", c.ID, title, "->", s.Grouping)
-
-	// build up the Extra section to comprise of the entire card.
 	for _, f := range c.Fields {
-		// we'll exclue what we already have above.
-		if f.Value == url ||
-			f.Value == login ||
-			f.Value == pass {
-			continue
+		ef := entryField{Name: f.Name, Type: f.FieldType, Value: f.Value}
+		if f.FieldType == fieldTypeOTP && f.Value != "" && e.OTP == "" {
+			e.OTP = f.Value
+			ef.Role = roleOTP
 		}
-		s.Extra = s.Extra + fmt.Sprintf(extraFormat, f.Name, f.Value)
+		e.Fields = append(e.Fields, ef)
 	}
-	s.Extra = s.Extra + c.Notes
-
-	// add the original Labels this card was part of
-	labels := strings.Join(cardLabels(db, c), ", ")
-	if len(labels) > 0 {
-		s.Extra = s.Extra + `
-
-Labels: ` + labels
+	for _, file := range c.Files {
+		e.Attachments = append(e.Attachments, attachment{Name: file.Name, Data: file.Value})
 	}
-
-	// dump attachments for manual imports
-	if err := extractAttachments(c, title); err != nil {
-		return errors.Wrap(err, "extractAttachments returned error")
+	for _, image := range c.Images {
+		e.Attachments = append(e.Attachments, attachment{Image: true, Data: image.Value})
 	}
+	return e
+}
 
-	importedSites = append(importedSites, s)
-	return nil
+// loginPair holds the indexes into Card.Fields of a login and the password
+// and website paired with it.  Password and Website are -1 if none was found.
+type loginPair struct {
+	Login    int
+	Password int
+	Website  int
 }
 
-// note defines a Secure Note at LastPass.
+// loginPairs pairs every non-empty login on the card with the 1ST non-empty
+// password and website found at or after it, in the order of the fields
+// from sic.
 //
-// * URL must be set to "http://sn" for all entries.
-// * Username and Password must be BLANK for all entries, except for Servers.
-type note struct {
-	URL      string `csv:"url"`
-	Username string `csv:"username"`
-	Password string `csv:"password"`
-	Extra    string `csv:"extra"`
-	Name     string `csv:"name"`
-	Grouping string `csv:"grouping"`
-	Fav      string `csv:"fav"`
+// Note that this means two logins followed by two passwords will both be
+// paired with the first password.  See parse for the opinionated logic.
+func loginPairs(c safeincloud.Card) []loginPair {
+	var pairs []loginPair
+	for i, f := range c.Fields {
+		if f.FieldType != "login" || f.Value == "" {
+			continue
+		}
+		p := loginPair{Login: i, Password: -1, Website: -1}
+		for j := i; j < len(c.Fields); j++ {
+			if c.Fields[j].FieldType == "password" && c.Fields[j].Value != "" {
+				p.Password = j
+				break // break on the 1ST password found, don't keep loopin
+			}
+		}
+		for j := i; j < len(c.Fields); j++ {
+			if c.Fields[j].FieldType == "website" && c.Fields[j].Value != "" {
+				p.Website = j
+				break // break on the 1ST website found, don't keep loopin
+			}
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs
 }
 
-// importSecureNote assumes nothing.  It will attempt to take as much info
-// as possible from the SIC card and create a SecureNote for LastPass.
-func importSecureNote(db *safeincloud.Database, c safeincloud.Card, pf []string, df string) error {
+// siteTitle returns the title to use for a site with the website url.  If the
+// card's title is empty, the website without its scheme is used instead.
+func siteTitle(c safeincloud.Card, url string) string {
 	title := c.Title
 	if title == "" {
-		title = "SecureNote " + c.ID
-	}
-	n := note{
-		URL:      "http://sn", // must be set to this
-		Name:     title,
-		Username: "", // must be blank
-		Password: "", // must be blank
-	}
-	if c.Star {
-		glog.V(5).Infoln(c.ID, title, "found favorite.")
-		n.Fav = "1"
-	}
-	n.Grouping = primaryCardLabel(db, c, pf, df)
-	glog.Infoln("importing Secure Note", c.ID, title, "->", n.Grouping)
-
-	// build up the Extra section to comprise of the entire card.
-	//
-	// prefix with the expected NoteType, based on the Primary Grouping.
-	var prefix string
-	switch n.Grouping {
-	case "Credit Cards":
-		prefix = "NoteType:Credit Card"
-	case "Banking":
-		prefix = "NoteType:Bank Account"
-	case "Databases":
-		prefix = "NoteType:Database"
-	case "Licenses":
-		prefix = "NoteType:Driver's License"
-	case "Insurance":
-		prefix = "NoteType:Insurance"
-	case "Membership":
-		prefix = "NoteType:Membership"
-	case "Passport":
-		prefix = "NoteType:Passport"
-	case "Servers":
-		prefix = "NoteType:Server"
-	case "Software":
-		prefix = "NoteType:Software License"
-	}
-
-	if prefix != "" {
-		n.Extra = prefix + `
-
-` // LastPass expects a line break
-	}
-
-	// NOTE: it's best to go back into SafeInCloud and massage each FieldName
-	// to match that of LastPass' expected field name.
-	//
-	// see their import format: https://helpdesk.lastpass.com/importing-from-other-password-managers/
-	//
-	// For example, for Credit Cards, you want to edit each card
-	// in SafeInCloud to change "Owner" to "Name on Card", "CVV" to "Security Code"
-	// and so on.
-	for _, f := range c.Fields {
-		n.Extra = n.Extra + fmt.Sprintf(extraFormat, f.Name, f.Value)
-	}
-	n.Extra = n.Extra + c.Notes
-
-	// add the original Labels this card was part of
-	labels := strings.Join(cardLabels(db, c), ", ")
-	if len(labels) > 0 {
-		n.Extra = n.Extra + `
-
-Labels: ` + labels
-	}
-
-	// dump attachments for manual imports
-	if err := extractAttachments(c, title); err != nil {
-		return errors.Wrap(err, "extractAttachments returned error")
+		title = url
+		title = strings.Replace(title, "http://", "", -1)
+		title = strings.Replace(title, "https://", "", -1)
 	}
+	return title
+}
 
-	importedNotes = append(importedNotes, n)
-	return nil
+// noteTypes maps the groupings, or labels, to the LastPass Secure Note type
+// used for the cards in them.
+var noteTypes = map[string]string{
+	"Credit Cards": "Credit Card",
+	"Banking":      "Bank Account",
+	"Databases":    "Database",
+	"Licenses":     "Driver's License",
+	"Insurance":    "Insurance",
+	"Membership":   "Membership",
+	"Passport":     "Passport",
+	"Servers":      "Server",
+	"Software":     "Software License",
 }
 
-// extractAttachments takes a Card input and saves all attachments to disk.
-func extractAttachments(c safeincloud.Card, title string) error {
-	for i, file := range c.Files {
-		name := title + "_" + strconv.Itoa(i) + "_" + file.Name
-		if err := dumpfile(name, file.Value); err != nil {
-			return errors.Wrap(err, "dumpfile for files returned error")
-		}
-		glog.Warningln("  -", c.ID, title, "file attachment saved to", name)
-	}
-	for i, image := range c.Images {
-		// SafeInCloud forces all images to JPEG and compressed to 80%.
-		// this kind of screws up all sorts of images and filenames.  Therefore,
-		// all we can do is name the image via the title as a .jpg extension.
-		name := title + "_" + strconv.Itoa(i) + ".jpg"
-		if err := dumpfile(name, image.Value); err != nil {
-			return errors.Wrap(err, "dumpfile for images returned error")
-		}
-		glog.Warningln("  -", c.ID, title, "image attachment saved to", name)
-	}
-	return nil
+// noteType returns the LastPass Secure Note type to use for cards in the
+// grouping, or an empty string for a generic Secure Note.
+func noteType(grouping string) string {
+	return noteTypes[grouping]
 }
 
-// dumpfile will dump the binary contents of data to filename inside of a
-// directory called "attachments" where the utility is run.
-func dumpfile(filename string, data []byte) error {
-	cfilename := url.QueryEscape(filename)
-	cfilename = strings.Replace(cfilename, "%20", " ", -1)
-	dir := "attachments"
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return errors.Wrap(err, "os.MkdirAll returned error")
-	}
-	fullpath := dir + string(os.PathSeparator) + cfilename
-	if err := ioutil.WriteFile(fullpath, data, 0700); err != nil {
-		return errors.Wrap(err, "ioutil.WriteFile returned error")
-	}
-	return nil
+// noteTypeFields are the field names LastPass expects for each Secure Note
+// type.  Fields named exactly like these are filled in at LastPass instead of
+// ending up in the Notes blob.
+//
+// see their import format: https://helpdesk.lastpass.com/importing-from-other-password-managers/
+var noteTypeFields = map[string][]string{
+	"Credit Card":      {"Name on Card", "Type", "Number", "Security Code", "Start Date", "Expiration Date"},
+	"Bank Account":     {"Bank Name", "Account Type", "Routing Number", "Account Number", "SWIFT Code", "IBAN Number", "Pin", "Branch Address", "Branch Phone"},
+	"Database":         {"Type", "Hostname", "Port", "Database", "Username", "Password", "SID", "Alias"},
+	"Driver's License": {"Number", "Expiration Date", "License Class", "Name", "Address", "City / Town", "State", "ZIP / Postal Code", "Country", "Date of Birth", "Sex", "Height"},
+	"Insurance":        {"Company", "Policy Type", "Policy Number", "Expiration", "Agent Name", "Agent Phone", "URL"},
+	"Membership":       {"Organization", "Membership Number", "Member Name", "Start Date", "Expiration Date", "Website", "Telephone", "Password"},
+	"Passport":         {"Type", "Name", "Country", "Number", "Sex", "Nationality", "Date of Birth", "Issued Date", "Expiration Date"},
+	"Server":           {"Hostname", "Username", "Password"},
+	"Software License": {"License Key", "Licensee", "Version", "Publisher", "Support Email", "Website", "Price", "Purchase Date", "Order Number", "Number of Licenses", "Order Total"},
 }
 
 // primaryCardLabel looks at all the labels for the card and determines which
@@ -419,78 +480,17 @@ func cardLabels(db *safeincloud.Database, c safeincloud.Card) []string {
 	return labels
 }
 
-// writeSitesCSV takes a list of sites and writes them to a csv.
-func writeSitesCSV(sites []site) error {
-	f, err := os.Create("lastpass_sites.csv")
-	if err != nil {
-		return errors.Wrap(err, "os.Create error")
-	}
-	defer f.Close()
-	if len(sites) == 0 {
-		return nil
-	}
-
-	w := csv.NewWriter(f)
-	headers := csvHeaders(sites[0])
-	if err := w.Write(headers); err != nil {
-		return errors.Wrap(err, "writer.Write Headers error")
-	}
-	for _, s := range sites {
-		row := csvSlice(s)
-		if err := w.Write(row); err != nil {
-			return errors.Wrap(err, "writer.Write Entry error")
-		}
-	}
-	defer w.Flush()
-	return nil
-}
-
-// writeSecureNotesCSV takes a list of notes and writes them to a csv.
-func writeSecureNotesCSV(notes []note) error {
-	f, err := os.Create("lastpass_notes.csv")
-	if err != nil {
-		return errors.Wrap(err, "os.Create error")
-	}
-	defer f.Close()
-	if len(notes) == 0 {
-		return nil
-	}
+// fieldTypeOTP is the SafeInCloud field type of a one time password (TOTP).
+const fieldTypeOTP = "one_time_password"
 
-	w := csv.NewWriter(f)
-	headers := csvHeaders(notes[0])
-	if err := w.Write(headers); err != nil {
-		return errors.Wrap(err, "writer.Write Headers error")
-	}
-	for _, s := range notes {
-		row := csvSlice(s)
-		if err := w.Write(row); err != nil {
-			return errors.Wrap(err, "writer.Write Entry error")
-		}
+// isSecretType returns true if the SafeInCloud field type holds a secret
+// that should never be shown in the clear outside of the actual import.
+func isSecretType(fieldType string) bool {
+	switch fieldType {
+	case "password", "secret", "pin", fieldTypeOTP:
+		return true
 	}
-	defer w.Flush()
-	return nil
-}
-
-// csvHeaders evaluates a struct's tags and returns the csv headers.
-func csvHeaders(v interface{}) []string {
-	var results []string
-	value := reflect.ValueOf(v)
-	for i := 0; i < value.NumField(); i++ {
-		t := value.Type().Field(i).Tag
-		results = append(results, t.Get("csv"))
-	}
-	return results
-}
-
-// csvSlice evaluates a struct's fields and returns its values as strings.
-func csvSlice(v interface{}) []string {
-	var results []string
-	value := reflect.ValueOf(v)
-	for i := 0; i < value.NumField(); i++ {
-		f := value.Field(i)
-		results = append(results, f.String())
-	}
-	return results
+	return false
 }
 
 // init sets the the global flag and variables.
@@ -502,16 +502,39 @@ func init() {
 		script := os.Args[0]
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", script)
 		fmt.Fprintf(os.Stderr, "  %s -db /path/to/SafeInCloud_Export.xml [options]\n", script)
+		fmt.Fprintf(os.Stderr, "  %s -vault vault.json [options]\n", script)
+		fmt.Fprintf(os.Stderr, "  %s lint -db /path/to/SafeInCloud_Export.xml [options]\n", script)
+		fmt.Fprintf(os.Stderr, "  %s dump -db /path/to/SafeInCloud_Export.xml -o vault.json [options]\n", script)
+		fmt.Fprintf(os.Stderr, "  %s reverse -csv lastpass_export.csv -o SafeInCloud.xml\n", script)
+		fmt.Fprintf(os.Stderr, "  %s rewrite -db /path/to/SafeInCloud_Export.xml -rules rename.yaml -o fixed.xml\n", script)
+		fmt.Fprintf(os.Stderr, "  %s templates -db /path/to/SafeInCloud_Export.xml -o templates.json\n", script)
 		fmt.Fprintln(os.Stderr, "\nExamples:")
-		fmt.Fprintf(os.Stderr, "  %s -db SafeInCloud_2017-03-19.xml -p \"Credit Cards,Banking,Insurance\" -logtostderr -v 5\n", script)
+		fmt.Fprintf(os.Stderr, "  %s -db SafeInCloud_2017-03-19.xml -p \"Credit Cards,Banking,Insurance\" -v 5\n", script)
 		fmt.Fprintf(os.Stderr, "  %s -db SafeInCloud_2017-03-19.xml -d \"Untagged\" -p \"Credit Cards,Banking,Insurance\"\n", script)
-		fmt.Fprintf(os.Stderr, "  %s -db SafeInCloud_2017-03-19.xml -d \"Imported (SafeInCloud)\" -logtostderr -v 5\n", script)
-		fmt.Fprintf(os.Stderr, "  %s -db SafeInCloud_2017-03-19.xml -p \"Accounting,Software,Inventor\" -logtostderr -v 3\n", script)
+		fmt.Fprintf(os.Stderr, "  %s -db SafeInCloud_2017-03-19.xml -d \"Imported (SafeInCloud)\" -v 5\n", script)
+		fmt.Fprintf(os.Stderr, "  %s -db SafeInCloud_2017-03-19.xml -p \"Accounting,Software,Inventor\" -v 3\n", script)
+		fmt.Fprintf(os.Stderr, "  %s -vault vault.json -format lastpass,kdbx -kdbx-password-file master.txt\n", script)
 		fmt.Fprintln(os.Stderr, "\nAvailable flags:")
 		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "\nAvailable formats:")
+		for _, f := range formats {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", f.name, f.description)
+		}
 	}
 
-	flag.StringVar(&dbFile, "db", "", "An Exported SafeInCloud.xml path and filename.")
+	flag.StringVar(&dbFile, "db", "", "An Exported SafeInCloud.xml, or the encrypted SafeInCloud.db, path and filename.")
+	flag.StringVar(&vaultFile, "vault", "", "A vault JSON written by the dump subcommand to convert instead of -db.")
+	flag.StringVar(&formatsRaw, "format", "lastpass", "Output formats to write (comma delimited), see Available formats.")
 	flag.StringVar(&defaultFolder, "f", "Imported", "Default folder of unlabelled cards.")
 	flag.StringVar(&priorityFoldersRaw, "p", "", "Priority folder of labels to assign in order (comma delimited).")
+	flag.StringVar(&sortOrder, "sort", "db", "Order of the cards in every output: db (as in SafeInCloud) or modified (most recently modified first).")
+	flag.StringVar(&stateFile, "state", "", "Write the content hash of every converted card to this file, for -since-state of a later run.")
+	flag.StringVar(&sinceStateFile, "since-state", "", "Only convert the cards new or changed since the run that wrote this -state file, and list the removed ones in removed_cards.csv.")
+	flag.StringVar(&templatesFile, "templates", "", "Template definitions written by the templates subcommand, to map the cards created from a template to its NoteType.")
+	flag.BoolVar(&logToStderr, "logtostderr", false, "Deprecated: logs are always written to stderr.")
+	flag.BoolVar(&keepGoing, "keep-going", false, "Skip cards that fail to convert and report them at the end instead of aborting.")
+	passwordFlag(flag.CommandLine)
+	logFlags(flag.CommandLine)
+	filter = filterFlags(flag.CommandLine)
+	deletedOpts = deletedFlags(flag.CommandLine)
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cardMeta is the metadata of a card that the safeincloud package does not
+// parse, read from the attributes of its <card> element.  TimeStamp is the
+// last modification in milliseconds since the Unix epoch.
+type cardMeta struct {
+	ID        string `xml:"id,attr"`
+	Symbol    string `xml:"symbol,attr"`
+	Color     string `xml:"color,attr"`
+	TimeStamp string `xml:"time_stamp,attr"`
+
+	// TemplateID is the ID of the template the card was created from, for
+	// the exports that record it.
+	TemplateID string `xml:"template_id,attr"`
+}
+
+// readCardMeta reads the metadata of every card in the SafeInCloud XML, by
+// card ID.
+func readCardMeta(data []byte) (map[string]cardMeta, error) {
+	var db struct {
+		Cards []cardMeta `xml:"card"`
+	}
+	if err := xml.Unmarshal(data, &db); err != nil {
+		return nil, errors.Wrap(err, "xml.Unmarshal error")
+	}
+	meta := map[string]cardMeta{}
+	for _, m := range db.Cards {
+		meta[m.ID] = m
+	}
+	return meta, nil
+}
+
+// modified returns the last modification as RFC 3339 in UTC, or an empty
+// string if the card has none.
+func (m cardMeta) modified() string {
+	ms, err := strconv.ParseInt(strings.TrimSpace(m.TimeStamp), 10, 64)
+	if err != nil || ms <= 0 {
+		return ""
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+// applyMetadata sets the modification time, color, icon and template of every
+// entry from the metadata of its card.
+func applyMetadata(cards [][]entry, meta map[string]cardMeta) {
+	for _, entries := range cards {
+		for i := range entries {
+			e := &entries[i]
+			m, ok := meta[e.CardID]
+			if !ok {
+				continue
+			}
+			e.Modified = m.modified()
+			e.Color = m.Color
+			e.Symbol = m.Symbol
+			e.Template = m.TemplateID
+		}
+	}
+}
+
+// modifiedTime returns the last modification of the entry's card, or the
+// current time if it has none, for formats that require a timestamp.
+func modifiedTime(e entry) time.Time {
+	if t, err := time.Parse(time.RFC3339, e.Modified); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// sortByModified sorts the cards by their last modification, the most
+// recent first.  Cards without one keep their order, after all others.
+func sortByModified(cards [][]entry) {
+	modified := func(i int) time.Time {
+		t, _ := time.Parse(time.RFC3339, cards[i][0].Modified)
+		return t
+	}
+	sort.SliceStable(cards, func(i, j int) bool {
+		return modified(i).After(modified(j))
+	})
+}
+
+// metadataBlock returns the SafeInCloud metadata of the entry's card as
+// "Key: Value" lines for the notes.
+func metadataBlock(e entry) string {
+	lines := []string{"SafeInCloud ID: " + e.CardID}
+	if t, err := time.Parse(time.RFC3339, e.Modified); err == nil {
+		lines = append(lines, "Last Modified: "+t.UTC().Format("2006-01-02 15:04:05 UTC"))
+	}
+	if e.Color != "" {
+		lines = append(lines, "Color: "+e.Color)
+	}
+	if e.Symbol != "" {
+		lines = append(lines, "Icon: "+e.Symbol)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"flag"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	onePasswordCSVFile string
+	onePUXOutFile      string
+)
+
+func init() {
+	registerFormat("1password", "1Password csv of the logins only, written to -1password-csv", newOnePasswordCSVExporter)
+	registerFormat("1pux", "1Password 1PUX archive with every card and attachment, written to -1pux", newOnePUXExporter)
+
+	flag.StringVar(&onePasswordCSVFile, "1password-csv", "1password.csv", "Output path and filename for -format 1password.")
+	flag.StringVar(&onePUXOutFile, "1pux", "sic2lp.1pux", "Output path and filename for -format 1pux.")
+}
+
+// 1Password item categories, see the categoryUuid of a 1PUX item.
+const (
+	onePasswordLogin       = "001"
+	onePasswordCreditCard  = "002"
+	onePasswordSecureNote  = "003"
+	onePasswordBankAccount = "101"
+	onePasswordPassport    = "106"
+	onePasswordServer      = "110"
+)
+
+// onePasswordCategories maps the LastPass NoteType of a note to its 1Password
+// category.  Notes of any other NoteType become Secure Notes.
+var onePasswordCategories = map[string]string{
+	"Credit Card":  onePasswordCreditCard,
+	"Bank Account": onePasswordBankAccount,
+	"Passport":     onePasswordPassport,
+	"Server":       onePasswordServer,
+}
+
+// onePasswordFieldIDs maps the ID of each 1Password field of a category to
+// the field names that fill it in, compared with fieldNamed.
+var onePasswordFieldIDs = map[string]map[string][]string{
+	onePasswordCreditCard: {
+		"cardholder": {"name on card", "cardholder", "cardholder name", "owner"},
+		"type":       {"type", "brand"},
+		"ccnum":      {"number", "card number", "card #"},
+		"cvv":        {"security code", "cvv", "cvc", "cvv2", "code"},
+		"expiry":     {"expiration date", "expires", "expiration", "exp", "valid thru"},
+		"validFrom":  {"start date"},
+		"pin":        {"pin"},
+	},
+	onePasswordBankAccount: {
+		"bankName":      {"bank name", "bank"},
+		"owner":         {"name on account", "owner"},
+		"accountType":   {"account type", "type"},
+		"routingNo":     {"routing number", "routing"},
+		"accountNo":     {"account number", "account #"},
+		"swift":         {"swift code", "swift"},
+		"iban":          {"iban number", "iban"},
+		"telephonePin":  {"pin"},
+		"branchAddress": {"branch address"},
+		"branchPhone":   {"branch phone"},
+	},
+	onePasswordPassport: {
+		"type":            {"type"},
+		"issuing_country": {"country", "issuing country"},
+		"number":          {"number", "passport number", "passport #", "passport no"},
+		"fullname":        {"name", "full name"},
+		"sex":             {"sex"},
+		"nationality":     {"nationality"},
+		"birthdate":       {"date of birth"},
+		"issue_date":      {"issued date"},
+		"expiry_date":     {"expiration date"},
+	},
+	onePasswordServer: {
+		"url":      {"hostname", "url"},
+		"username": {"username"},
+		"password": {"password"},
+	},
+}
+
+// onePasswordCSVExporter writes the logins as a 1Password csv.  1Password
+// imports every csv row as a Login, so notes are left out; use 1pux for them.
+type onePasswordCSVExporter struct {
+	rows    []onePasswordRow
+	omitted int
+}
+
+func newOnePasswordCSVExporter() (Exporter, error) {
+	return &onePasswordCSVExporter{}, nil
+}
+
+// onePasswordRow is a single row of a 1Password csv import.
+type onePasswordRow struct {
+	Title    string `csv:"Title"`
+	URL      string `csv:"Url"`
+	Username string `csv:"Username"`
+	Password string `csv:"Password"`
+	OTPAuth  string `csv:"OTPAuth"`
+	Favorite string `csv:"Favorite"`
+	Archived string `csv:"Archived"`
+	Tags     string `csv:"Tags"`
+	Notes    string `csv:"Notes"`
+}
+
+// Add converts every site to a csv row.  The fields not used by the login
+// are appended to the notes, the same way as for LastPass.
+func (x *onePasswordCSVExporter) Add(entries []entry) error {
+	for _, e := range entries {
+		if e.Kind != entrySite {
+			x.omitted++
+			continue
+		}
+		r := onePasswordRow{
+			Title:    e.Title,
+			URL:      e.URL,
+			Username: e.Username,
+			Password: e.Password,
+			Favorite: "false",
+			Archived: "false",
+			Tags:     strings.Join(e.Labels, ","),
+		}
+		if e.OTP != "" {
+			r.OTPAuth = otpauthURI(e.OTP, e.Title, e.Username)
+		}
+		if e.Favorite {
+			r.Favorite = "true"
+		}
+		r.Notes = siteNotes(e)
+		x.rows = append(x.rows, r)
+	}
+	return nil
+}
+
+// Write writes all rows to onePasswordCSVFile.
+func (x *onePasswordCSVExporter) Write() error {
+	if x.omitted > 0 {
+		logger.Warn("notes are not written to the 1Password csv, use -format 1pux for them", "omitted", x.omitted)
+	}
+	var rows [][]string
+	for _, r := range x.rows {
+		rows = append(rows, csvSlice(r))
+	}
+	// the csv is meant to be imported, so every cell is written verbatim.
+	return writeCSV(onePasswordCSVFile, csvHeaders(onePasswordRow{}), rows, false)
+}
+
+// onePUXExporter writes every entry, with its attachments, as a 1Password
+// Unencrypted Export (1PUX) archive.
+type onePUXExporter struct {
+	items []onePUXItem
+	files []onePUXFile
+}
+
+func newOnePUXExporter() (Exporter, error) {
+	return &onePUXExporter{}, nil
+}
+
+// onePUXFile is an attachment to add to the files/ directory of the archive.
+type onePUXFile struct {
+	documentID string
+	name       string
+	data       []byte
+}
+
+// the 1PUX export.attributes and export.data documents.  Only what 1Password
+// needs to import is written.
+type onePUXAttributes struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+type onePUXData struct {
+	Accounts []onePUXAccount `json:"accounts"`
+}
+
+type onePUXAccount struct {
+	Attrs  onePUXAccountAttrs `json:"attrs"`
+	Vaults []onePUXVault      `json:"vaults"`
+}
+
+type onePUXAccountAttrs struct {
+	AccountName string `json:"accountName"`
+	Name        string `json:"name"`
+	UUID        string `json:"uuid"`
+}
+
+type onePUXVault struct {
+	Attrs onePUXVaultAttrs `json:"attrs"`
+	Items []onePUXItem     `json:"items"`
+}
+
+type onePUXVaultAttrs struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type onePUXItem struct {
+	UUID         string         `json:"uuid"`
+	FavIndex     int            `json:"favIndex"`
+	CreatedAt    int64          `json:"createdAt"`
+	UpdatedAt    int64          `json:"updatedAt"`
+	State        string         `json:"state"`
+	CategoryUUID string         `json:"categoryUuid"`
+	Details      onePUXDetails  `json:"details"`
+	Overview     onePUXOverview `json:"overview"`
+}
+
+type onePUXDetails struct {
+	LoginFields []onePUXLoginField `json:"loginFields"`
+	NotesPlain  string             `json:"notesPlain"`
+	Sections    []onePUXSection    `json:"sections"`
+}
+
+type onePUXLoginField struct {
+	Value       string `json:"value"`
+	Name        string `json:"name"`
+	FieldType   string `json:"fieldType"`
+	Designation string `json:"designation"`
+}
+
+type onePUXSection struct {
+	Title  string        `json:"title"`
+	Name   string        `json:"name"`
+	Fields []onePUXField `json:"fields"`
+}
+
+type onePUXField struct {
+	Title string                 `json:"title"`
+	ID    string                 `json:"id"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type onePUXOverview struct {
+	Title string      `json:"title"`
+	URL   string      `json:"url,omitempty"`
+	URLs  []onePUXURL `json:"urls,omitempty"`
+	Tags  []string    `json:"tags,omitempty"`
+}
+
+type onePUXURL struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+// Add converts every entry to a 1PUX item.  Sites become Logins, notes of the
+// Credit Card, Bank Account, Passport and Server NoteTypes become items of
+// that category, and all other notes become Secure Notes.
+//
+// Every label becomes a tag, as 1Password has no folders.  The entries of a
+// card share its attachments, so they are only attached to its first item.
+func (x *onePUXExporter) Add(entries []entry) error {
+	var items []onePUXItem
+	var files []onePUXFile
+	for i, e := range entries {
+		if i > 0 {
+			e.Attachments = nil
+		}
+		item, fs := onePUXItemFor(e)
+		items = append(items, item)
+		files = append(files, fs...)
+	}
+	x.items = append(x.items, items...)
+	x.files = append(x.files, files...)
+	return nil
+}
+
+// Write writes all items and files to onePUXOutFile.
+func (x *onePUXExporter) Write() error {
+	return writeOnePUX(onePUXOutFile, x.items, x.files)
+}
+
+// onePUXItemFor converts a single entry to a 1PUX item and the attachments
+// it references.
+func onePUXItemFor(e entry) (onePUXItem, []onePUXFile) {
+	// SafeInCloud only keeps the last modification of a card.
+	modified := modifiedTime(e).Unix()
+	item := onePUXItem{
+		UUID:         newOnePasswordUUID(),
+		CreatedAt:    modified,
+		UpdatedAt:    modified,
+		State:        "active",
+		CategoryUUID: onePasswordSecureNote,
+		Overview:     onePUXOverview{Title: e.Title, Tags: e.Labels},
+	}
+	if e.Favorite {
+		item.FavIndex = 1
+	}
+	if c, ok := onePasswordCategories[e.NoteType]; ok && e.Kind == entryNote {
+		item.CategoryUUID = c
+	}
+	if e.Kind == entrySite {
+		item.CategoryUUID = onePasswordLogin
+		item.Overview.URL = e.URL
+		item.Overview.URLs = []onePUXURL{{URL: e.URL}}
+		item.Details.LoginFields = []onePUXLoginField{
+			{Value: e.Username, Name: "username", FieldType: "T", Designation: "username"},
+			{Value: e.Password, Name: "password", FieldType: "P", Designation: "password"},
+		}
+	}
+	item.Details.NotesPlain = e.Notes
+
+	// the fields 1Password knows for the category go into the unnamed first
+	// section, everything else into a SafeInCloud section.  1Password keeps
+	// one value per field ID, so only the first field matching an ID fills it
+	// in, and any other, such as "Card Number" after "Number", is custom.
+	known := onePUXSection{Fields: []onePUXField{}}
+	other := onePUXSection{Title: "SafeInCloud", Name: "safeincloud", Fields: []onePUXField{}}
+	used := map[string]bool{}
+	for i, f := range e.Fields {
+		if f.Role == roleLogin || f.Role == rolePassword || f.Role == roleWebsite {
+			continue
+		}
+		if id := onePasswordFieldID(item.CategoryUUID, f); id != "" && !used[id] {
+			used[id] = true
+			known.Fields = append(known.Fields, onePUXField{Title: f.Name, ID: id, Value: onePUXValue(id, f)})
+			continue
+		}
+		other.Fields = append(other.Fields, onePUXField{Title: f.Name, ID: "field" + strconv.Itoa(i), Value: onePUXValue("", f)})
+	}
+
+	var files []onePUXFile
+	var images int
+	for _, a := range e.Attachments {
+		name := a.Name
+		if a.Image {
+			name = imageFilename(images, a.Data)
+			images++
+		}
+		id := newOnePasswordUUID()
+		files = append(files, onePUXFile{documentID: id, name: name, data: a.Data})
+		other.Fields = append(other.Fields, onePUXField{Title: name, ID: id, Value: map[string]interface{}{
+			"file": map[string]interface{}{"fileName": name, "documentId": id, "decryptedSize": len(a.Data)},
+		}})
+	}
+
+	for _, s := range []onePUXSection{known, other} {
+		if len(s.Fields) > 0 {
+			item.Details.Sections = append(item.Details.Sections, s)
+		}
+	}
+	return item, files
+}
+
+// onePasswordFieldID returns the ID of the 1Password field of the category
+// that f fills in, or an empty string if none.
+func onePasswordFieldID(category string, f entryField) string {
+	for id, names := range onePasswordFieldIDs[category] {
+		if fieldNamed(f, names...) {
+			return id
+		}
+	}
+	return ""
+}
+
+// onePUXValue returns the typed 1PUX value of a field filling in the
+// 1Password field id, or of a custom field if id is empty.
+func onePUXValue(id string, f entryField) map[string]interface{} {
+	switch {
+	case id == "ccnum":
+		return map[string]interface{}{"creditCardNumber": f.Value}
+	case id == "expiry" || id == "validFrom":
+		month, year := parseExpiry(f.Value)
+		m, _ := strconv.Atoi(month)
+		y, err := strconv.Atoi(year)
+		if err != nil || m < 1 || m > 12 {
+			return map[string]interface{}{"string": f.Value}
+		}
+		return map[string]interface{}{"monthYear": y*100 + m}
+	case f.Role == roleOTP || f.Type == fieldTypeOTP:
+		return map[string]interface{}{"totp": f.Value}
+	case isSecretType(f.Type) || id == "cvv" || id == "pin" || id == "password" || id == "telephonePin":
+		return map[string]interface{}{"concealed": f.Value}
+	}
+	return map[string]interface{}{"string": f.Value}
+}
+
+// writeOnePUX writes the items as a 1PUX archive to filename: a zip holding
+// export.attributes, export.data and the attachments in files/.
+func writeOnePUX(filename string, items []onePUXItem, files []onePUXFile) error {
+	if items == nil {
+		items = []onePUXItem{}
+	}
+	data := onePUXData{Accounts: []onePUXAccount{{
+		Attrs: onePUXAccountAttrs{AccountName: "SafeInCloud", Name: "SafeInCloud", UUID: newOnePasswordUUID()},
+		Vaults: []onePUXVault{{
+			Attrs: onePUXVaultAttrs{UUID: newOnePasswordUUID(), Name: "SafeInCloud", Type: "U"},
+			Items: items,
+		}},
+	}}}
+	attrs := onePUXAttributes{Version: 3, Description: "1Password Unencrypted Export", CreatedAt: time.Now().Unix()}
+
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		z := zip.NewWriter(w)
+		for _, doc := range []struct {
+			name string
+			v    interface{}
+		}{{"export.attributes", attrs}, {"export.data", data}} {
+			f, err := z.Create(doc.name)
+			if err != nil {
+				return errors.Wrap(err, "zip.Create error")
+			}
+			if err := json.NewEncoder(f).Encode(doc.v); err != nil {
+				return errors.Wrap(err, "json.Encode error")
+			}
+		}
+		for _, file := range files {
+			f, err := z.Create("files/" + file.documentID + "__" + strings.Replace(file.name, "/", "_", -1))
+			if err != nil {
+				return errors.Wrap(err, "zip.Create error")
+			}
+			if _, err := f.Write(file.data); err != nil {
+				return errors.Wrap(err, "zip.Write error")
+			}
+		}
+		if err := z.Close(); err != nil {
+			return errors.Wrap(err, "zip.Close error")
+		}
+		return nil
+	})
+}
+
+// newOnePasswordUUID returns a random ID in the 26 character base32 form
+// 1Password uses.
+func newOnePasswordUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b[:]))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// outputs tracks every file this run has written, or is in the middle of
+// writing, so that an interrupted run can remove them all.
+var outputs = &outputFiles{}
+
+// outputFiles is a registry of files written during a run.
+//
+// A run that is interrupted half way through leaves a set of csvs and
+// attachments that look complete, but are not.  Someone will eventually import
+// them.  Therefore, everything written is tracked and removed on interrupt.
+type outputFiles struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// add tracks path as an output of this run.
+func (o *outputFiles) add(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.paths = append(o.paths, path)
+}
+
+// rename moves the temporary file tmp into its final place at path while
+// holding the lock, so that it never races with removeAll.  The directory is
+// synced after, as the rename is not durable across a crash until it is.
+func (o *outputFiles) rename(tmp, path string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "os.Rename error")
+	}
+	o.paths = append(o.paths, path)
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory entries of dir to disk.
+//
+// Windows cannot sync a directory, and does not need to: a rename there is
+// already durable once it returns.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "os.Open error")
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return errors.Wrap(err, "dir.Sync error")
+	}
+	return d.Close()
+}
+
+// removeAll deletes every tracked output.  The lock is intentionally never
+// released as the process is expected to exit right after.
+//
+// The paths are not logged, as the files written for a card are named after
+// its title.
+func (o *outputFiles) removeAll() {
+	o.mu.Lock()
+	removed := 0
+	for _, p := range o.paths {
+		err := os.Remove(p)
+		switch {
+		case os.IsNotExist(err):
+			// a temporary file already renamed, or never created.
+		case err != nil:
+			logger.Error("unable to remove partial output", "err", err)
+		default:
+			removed++
+		}
+	}
+	logger.Warn("removed partial outputs", "files", removed)
+}
+
+// handleInterrupts removes all partial outputs if the run is interrupted with
+// Ctrl-C (SIGINT) or killed with SIGTERM.
+func handleInterrupts() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		logger.Warn("interrupted, removing partial outputs", "signal", sig.String())
+		outputs.removeAll()
+		os.Exit(130)
+	}()
+}
+
+// writeFileAtomic writes filename by calling write with a temporary file in the
+// same directory.  Only once write has returned without error, and the
+// temporary file has been synced to disk, is it renamed over filename and the
+// directory synced.
+//
+// A failed or interrupted write therefore never leaves a truncated file behind.
+// The file is created with 0600 permissions as it will most likely hold
+// secrets.
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return errors.Wrap(err, "ioutil.TempFile error")
+	}
+	outputs.add(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "file.Sync error")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "file.Close error")
+	}
+	if err := outputs.rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "outputs.rename error")
+	}
+	return nil
+}
+
+// removeStale removes filename left over from a previous run, if it exists.
+//
+// This is used when there is nothing to write to filename: leaving the old
+// file behind would make it look like it belongs to this run.
+func removeStale(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "os.Remove error")
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	passDir           string
+	passGPG           string
+	passRecipientsRaw string
+	passPlaintext     bool
+)
+
+func init() {
+	registerFormat("pass", "password-store (pass) tree, written to -pass-dir and encrypted with -pass-recipients", newPassExporter)
+
+	flag.StringVar(&passDir, "pass-dir", "password-store", "Output directory of the password-store tree for -format pass.")
+	flag.StringVar(&passGPG, "pass-gpg", "gpg", "The gpg binary used to encrypt for -format pass.")
+	flag.StringVar(&passRecipientsRaw, "pass-recipients", "", "GPG key IDs to encrypt to for -format pass (comma delimited), required unless -pass-plaintext.")
+	flag.BoolVar(&passPlaintext, "pass-plaintext", false, "Write -format pass as unencrypted .txt files instead, which pass cannot read, to encrypt some other way.")
+}
+
+// passExporter writes a password-store tree, one file per entry in a
+// directory per folder, with the attachments of an entry next to it.
+type passExporter struct {
+	recipients []string
+	files      []passFile
+	taken      map[string]bool
+}
+
+// passFile is a single file of the tree, relative to passDir and without
+// its .gpg extension.  Unencrypted entries get a .txt extension instead,
+// unencrypted attachments none.
+type passFile struct {
+	path       string
+	data       []byte
+	attachment bool
+}
+
+// newPassExporter checks the recipients and looks up gpg up front so that a
+// missing binary fails the run before anything is converted.
+//
+// pass can only read a tree encrypted to its .gpg-id, so an unencrypted tree
+// is only written when asked for explicitly with "-pass-plaintext".
+func newPassExporter() (Exporter, error) {
+	x := &passExporter{taken: map[string]bool{}}
+	for _, r := range strings.Split(passRecipientsRaw, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			x.recipients = append(x.recipients, r)
+		}
+	}
+	switch {
+	case passPlaintext && len(x.recipients) > 0:
+		return nil, errors.New("-pass-recipients and -pass-plaintext cannot be used together")
+	case passPlaintext:
+		return x, nil
+	case len(x.recipients) == 0:
+		return nil, errors.New("-pass-recipients is required, or -pass-plaintext to write unencrypted .txt files")
+	}
+	if _, err := exec.LookPath(passGPG); err != nil {
+		return nil, errors.Wrap(err, "-pass-gpg not found")
+	}
+	return x, nil
+}
+
+// Add converts every entry to a pass file named after its folder, title and,
+// for sites, login.  The password is on the first line, followed by every
+// other field as "key: value" lines and the notes.
+func (x *passExporter) Add(entries []entry) error {
+	for _, e := range entries {
+		name := x.unique(passEntryPath(e), "")
+		x.files = append(x.files, passFile{path: name, data: passContent(e)})
+
+		var images int
+		for _, a := range e.Attachments {
+			an := passClean(a.Name)
+			if an == "" {
+				an = "attachment"
+			}
+			if a.Image {
+				an = imageFilename(images, a.Data)
+				images++
+			}
+			ext := filepath.Ext(an)
+			path := x.unique(name+".attachments/"+strings.TrimSuffix(an, ext), ext)
+			x.files = append(x.files, passFile{path: path, data: a.Data, attachment: true})
+		}
+	}
+	return nil
+}
+
+// unique returns name with ext, numbered "name (2)ext" and so on if that is
+// already taken by another entry or attachment.  Names are compared ignoring
+// case, as they would overwrite each other on a case-insensitive file system.
+func (x *passExporter) unique(name, ext string) string {
+	path := name + ext
+	for n := 2; x.taken[strings.ToLower(path)]; n++ {
+		path = name + " (" + strconv.Itoa(n) + ")" + ext
+	}
+	x.taken[strings.ToLower(path)] = true
+	return path
+}
+
+// Write writes every file below passDir, encrypted to the recipients if any
+// were given.
+func (x *passExporter) Write() error {
+	if len(x.recipients) == 0 {
+		logger.Warn("-pass-plaintext, writing the tree unencrypted", "dir", passDir)
+	} else {
+		if err := os.MkdirAll(passDir, 0700); err != nil {
+			return errors.Wrap(err, "os.MkdirAll error")
+		}
+		ids := []byte(strings.Join(x.recipients, "\n") + "\n")
+		if err := writeFileAtomic(filepath.Join(passDir, ".gpg-id"), func(w io.Writer) error {
+			_, err := w.Write(ids)
+			return err
+		}); err != nil {
+			return errors.Wrap(err, "writeFileAtomic .gpg-id error")
+		}
+	}
+
+	for _, f := range x.files {
+		path := filepath.Join(passDir, filepath.FromSlash(f.path))
+		switch {
+		case len(x.recipients) > 0:
+			path += ".gpg"
+		case !f.attachment:
+			path += ".txt"
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return errors.Wrap(err, "os.MkdirAll error")
+		}
+		data := f.data
+		if len(x.recipients) > 0 {
+			var err error
+			if data, err = gpgEncrypt(passGPG, x.recipients, data); err != nil {
+				// the path holds the folder, title and login, which must
+				// not reach the logs.
+				return errors.Wrap(err, "gpgEncrypt error")
+			}
+		}
+		if err := writeFileAtomic(path, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}); err != nil {
+			return errors.Wrap(err, "writeFileAtomic error")
+		}
+	}
+	return nil
+}
+
+// passEntryPath returns the path of the entry in the tree, without an
+// extension: the folder, nested as by folderPath, the title and the login of
+// a site.
+func passEntryPath(e entry) string {
+	var parts []string
+	for _, p := range folderPath(e.Folder) {
+		if p = passClean(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	parts = append(parts, passClean(e.Title))
+	if e.Kind == entrySite && e.Username != "" {
+		parts = append(parts, passClean(e.Username))
+	}
+	return strings.Join(parts, "/")
+}
+
+// passClean makes a title, login or folder usable as a single path element.
+func passClean(name string) string {
+	name = strings.TrimSpace(name)
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', 0:
+			return '-'
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// passContent returns the content of the entry's pass file: the password on
+// the first line, as pass expects, followed by the login, website, OTP as an
+// otpauth:// URI for pass-otp, every other field, the labels and the notes.
+//
+// Notes have no password, so the first secret field is used instead, or the
+// first line is left empty.
+func passContent(e entry) []byte {
+	var b bytes.Buffer
+	password := e.Password
+	used := -1
+	if e.Kind != entrySite {
+		for i, f := range e.Fields {
+			if isSecretType(f.Type) && f.Type != fieldTypeOTP && f.Value != "" {
+				password, used = f.Value, i
+				break
+			}
+		}
+	}
+	b.WriteString(password + "\n")
+	if e.Username != "" {
+		b.WriteString("login: " + e.Username + "\n")
+	}
+	if e.URL != "" {
+		b.WriteString("url: " + e.URL + "\n")
+	}
+	if e.OTP != "" {
+		b.WriteString(otpauthURI(e.OTP, e.Title, e.Username) + "\n")
+	}
+	for i, f := range e.Fields {
+		if f.Role != "" || i == used || f.Value == "" {
+			continue
+		}
+		// pass has no multi line values, so indent continuation lines.
+		b.WriteString(f.Name + ": " + strings.Replace(f.Value, "\n", "\n  ", -1) + "\n")
+	}
+	if len(e.Labels) > 0 {
+		b.WriteString("labels: " + strings.Join(e.Labels, ", ") + "\n")
+	}
+	if e.Notes != "" {
+		b.WriteString("\n" + e.Notes + "\n")
+	}
+	return b.Bytes()
+}
+
+// gpgEncrypt encrypts data to the recipients with the gpg binary, using the
+// same options as pass itself.
+func gpgEncrypt(gpg string, recipients []string, data []byte) ([]byte, error) {
+	args := []string{"--batch", "--quiet", "--yes", "--compress-algo=none", "--no-encrypt-to", "--encrypt"}
+	for _, r := range recipients {
+		args = append(args, "--recipient", r)
+	}
+	args = append(args, "--output", "-")
+
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(gpg, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "gpg: %s", strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
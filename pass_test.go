@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// tempDir returns a new temporary directory, removed when the test ends.
+func tempDir(t *testing.T, prefix string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// setPassFlags sets the -format pass flags for the test, and restores them
+// when it ends.
+func setPassFlags(t *testing.T, dir, gpg, recipients string, plaintext bool) {
+	t.Helper()
+	oldDir, oldGPG, oldRecipients, oldPlaintext := passDir, passGPG, passRecipientsRaw, passPlaintext
+	t.Cleanup(func() {
+		passDir, passGPG, passRecipientsRaw, passPlaintext = oldDir, oldGPG, oldRecipients, oldPlaintext
+	})
+	passDir, passGPG, passRecipientsRaw, passPlaintext = dir, gpg, recipients, plaintext
+}
+
+// gpgHome sets up a throwaway GnuPG home with a key for recipient, without a
+// passphrase, and returns the gpg binary.  The test is skipped without gpg.
+func gpgHome(t *testing.T, recipient string) string {
+	t.Helper()
+	gpg, err := exec.LookPath("gpg")
+	if err != nil {
+		t.Skip("gpg not found")
+	}
+	// gpg-agent's socket path is limited in length, so stay short.
+	home := tempDir(t, "gpg")
+	if err := os.Chmod(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNUPGHOME", home)
+	t.Cleanup(func() { exec.Command("gpgconf", "--kill", "gpg-agent").Run() })
+
+	cmd := exec.Command(gpg, "--batch", "--passphrase", "", "--quick-generate-key", recipient, "default", "default", "never")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gpg --quick-generate-key: %v\n%s", err, out)
+	}
+	return gpg
+}
+
+// gpgDecrypt decrypts the file at path with the key in the GnuPG home.
+func gpgDecrypt(t *testing.T, gpg, path string) []byte {
+	t.Helper()
+	var stderr bytes.Buffer
+	cmd := exec.Command(gpg, "--batch", "--quiet", "--decrypt", path)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("gpg --decrypt %s: %v\n%s", path, err, stderr.String())
+	}
+	return out
+}
+
+func TestGPGEncrypt(t *testing.T) {
+	gpg := gpgHome(t, "sic2lp-test@example.com")
+
+	data := []byte("secret\nlogin: bob\n")
+	enc, err := gpgEncrypt(gpg, []string{"sic2lp-test@example.com"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(enc, []byte("secret")) {
+		t.Fatal("encrypted data contains the plaintext")
+	}
+	path := filepath.Join(tempDir(t, "pass"), "entry.gpg")
+	if err := ioutil.WriteFile(path, enc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := gpgDecrypt(t, gpg, path); !bytes.Equal(got, data) {
+		t.Fatalf("decrypted %q, want %q", got, data)
+	}
+}
+
+func TestPassExporterWrite(t *testing.T) {
+	gpg := gpgHome(t, "sic2lp-test@example.com")
+
+	dir := tempDir(t, "pass")
+	setPassFlags(t, dir, gpg, "sic2lp-test@example.com", false)
+	x, err := newPassExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entry{
+		CardID:   "10",
+		Kind:     entrySite,
+		Title:    "Google",
+		Folder:   `Archive\Google`,
+		Username: "bob@example.com",
+		Password: "=secret",
+		URL:      "https://accounts.google.com",
+		Fields: []entryField{
+			{Name: "Login", Type: "login", Value: "bob@example.com", Role: roleLogin},
+			{Name: "Password", Type: "password", Value: "=secret", Role: rolePassword},
+			{Name: "Website", Type: "website", Value: "https://accounts.google.com", Role: roleWebsite},
+			{Name: "PIN", Type: "pin", Value: "1234"},
+		},
+		Attachments: []attachment{
+			{Name: "codes.txt", Data: []byte("first")},
+			{Name: "Codes.txt", Data: []byte("second")},
+		},
+	}
+	if err := x.Add([]entry{e}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := ioutil.ReadFile(filepath.Join(dir, ".gpg-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ids) != "sic2lp-test@example.com\n" {
+		t.Errorf(".gpg-id is %q", ids)
+	}
+
+	entryPath := filepath.Join(dir, "Archive", "Google", "Google", "bob@example.com")
+	got := gpgDecrypt(t, gpg, entryPath+".gpg")
+	want := "=secret\nlogin: bob@example.com\nurl: https://accounts.google.com\nPIN: 1234\n"
+	if string(got) != want {
+		t.Errorf("entry is %q, want %q", got, want)
+	}
+
+	// attachments of the same name must not overwrite each other.
+	for name, want := range map[string]string{"codes.txt": "first", "Codes (2).txt": "second"} {
+		got := gpgDecrypt(t, gpg, filepath.Join(entryPath+".attachments", name+".gpg"))
+		if string(got) != want {
+			t.Errorf("attachment %s is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPassExporterRequiresRecipients(t *testing.T) {
+	setPassFlags(t, tempDir(t, "pass"), "gpg", "", false)
+	if _, err := newPassExporter(); err == nil {
+		t.Fatal("no error without -pass-recipients")
+	}
+	passPlaintext = true
+	if _, err := newPassExporter(); err != nil {
+		t.Fatalf("-pass-plaintext: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/eduncan911/safeincloud"
+	"github.com/pkg/errors"
+)
+
+// lastpassSecureNoteURL is the url LastPass exports for every Secure Note.
+const lastpassSecureNoteURL = "http://sn"
+
+// noteFieldTypes maps lower cased LastPass Secure Note field names to the
+// SafeInCloud field type to use for them, in addition to fieldTypeHints.
+var noteFieldTypes = map[string]string{
+	"pin":             "pin",
+	"security code":   "pin",
+	"number":          "number",
+	"account number":  "number",
+	"routing number":  "number",
+	"expiration date": "expiry",
+	"hostname":        "website",
+	"email":           "email",
+	"support email":   "email",
+	"telephone":       "phone",
+	"branch phone":    "phone",
+	"agent phone":     "phone",
+}
+
+// runReverse runs the "reverse" subcommand with args and returns the exit
+// code.
+//
+// Reverse converts a LastPass csv export back into a SafeInCloud XML that
+// SafeInCloud can import.
+func runReverse(args []string) int {
+	fs := flag.NewFlagSet("reverse", flag.ExitOnError)
+	var in, out string
+	fs.StringVar(&in, "csv", "", "A LastPass csv export path and filename.")
+	fs.StringVar(&out, "o", "SafeInCloud.xml", "Output path and filename of the SafeInCloud XML.")
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s reverse:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s reverse -csv lastpass_export.csv -o SafeInCloud.xml\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "\nAvailable flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if in == "" {
+		fs.Usage()
+		return 0
+	}
+	handleInterrupts()
+
+	f, err := os.Open(in)
+	if err != nil {
+		logger.Error("unable to open LastPass csv", "err", err)
+		return 10
+	}
+	defer f.Close()
+	db, err := reverseLastPass(f)
+	if err != nil {
+		logger.Error("unable to parse LastPass csv", "err", err)
+		return 10
+	}
+	if err := writeSafeInCloudXML(out, db); err != nil {
+		logger.Error("unable to write SafeInCloud XML", "err", err)
+		return 12
+	}
+	logger.Info("totals", "cards", len(db.Cards), "labels", len(db.Labels))
+	return 0
+}
+
+// reverseLastPass reads a LastPass csv export and converts every row to a
+// SafeInCloud card.
+//
+// Sites become cards with a login, password and website field, and their
+// extra becomes the notes.  Secure Notes with a NoteType have their
+// "Key:Value" lines turned back into typed fields, and every other Secure
+// Note becomes a card with just notes.  The grouping becomes a label, and so
+// does the label that selects the card's NoteType, see noteTypes.
+func reverseLastPass(r io.Reader) (*safeincloud.Database, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "csv.ReadAll error")
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("csv is empty")
+	}
+	cols := map[string]int{}
+	for i, h := range rows[0] {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, h := range []string{"url", "username", "password", "extra", "name", "grouping"} {
+		if _, ok := cols[h]; !ok {
+			return nil, errors.Errorf("csv has no %q column, is it a LastPass export?", h)
+		}
+	}
+
+	db := &safeincloud.Database{}
+	labels := map[string]string{}
+	labelID := func(name string) string {
+		id, ok := labels[name]
+		if !ok {
+			id = strconv.Itoa(len(labels) + 1)
+			labels[name] = id
+			db.Labels = append(db.Labels, safeincloud.Label{ID: id, Name: name})
+		}
+		return id
+	}
+
+	for i, row := range rows[1:] {
+		get := func(h string) string {
+			if n, ok := cols[h]; ok && n < len(row) {
+				return row[n]
+			}
+			return ""
+		}
+		c := safeincloud.Card{
+			ID:    strconv.Itoa(i + 1),
+			Title: get("name"),
+			Star:  get("fav") == "1",
+		}
+		var nt string
+		if get("url") == lastpassSecureNoteURL {
+			nt, c.Fields, c.Notes = reverseSecureNote(get("extra"))
+		} else {
+			c.Fields = []safeincloud.Field{
+				{Name: "Login", FieldType: "login", Value: get("username")},
+				{Name: "Password", FieldType: "password", Value: get("password")},
+				{Name: "Website", FieldType: "website", Value: get("url")},
+			}
+			if totp := get("totp"); totp != "" {
+				c.Fields = append(c.Fields, safeincloud.Field{Name: "One-time password", FieldType: fieldTypeOTP, Value: totp})
+			}
+			c.Notes = get("extra")
+		}
+		var names []string
+		c.Notes, names = reverseLabels(c.Notes)
+		if g := strings.TrimSpace(get("grouping")); g != "" {
+			names = append([]string{g}, names...)
+		}
+		for _, name := range names {
+			if id := labelID(name); !containsString(c.LabelIDs, id) {
+				c.LabelIDs = append(c.LabelIDs, id)
+			}
+		}
+		for label, t := range noteTypes {
+			if t == nt && !containsString(c.LabelIDs, labels[label]) {
+				c.LabelIDs = append(c.LabelIDs, labelID(label))
+			}
+		}
+		logV(5, "reversed", "card", c.ID, "note_type", nt)
+		db.Cards = append(db.Cards, c)
+	}
+	return db, nil
+}
+
+// reverseSecureNote parses the extra of a LastPass Secure Note into its
+// NoteType, typed fields and notes.
+//
+// A NoteType note is a "NoteType:" line followed by "Key:Value" lines, where
+// a line without a colon continues the previous value and everything after
+// the "Notes:" key is the notes.  A note without a NoteType is all notes.
+func reverseSecureNote(extra string) (nt string, fields []safeincloud.Field, notes string) {
+	extra = strings.Replace(extra, "\r\n", "\n", -1)
+	if !strings.HasPrefix(extra, "NoteType:") {
+		return "", nil, extra
+	}
+	lines := strings.Split(extra, "\n")
+	nt = strings.TrimSpace(strings.TrimPrefix(lines[0], "NoteType:"))
+	for i := 1; i < len(lines); i++ {
+		l := lines[i]
+		n := strings.Index(l, ":")
+		if n < 0 {
+			if len(fields) > 0 && l != "" {
+				fields[len(fields)-1].Value += "\n" + l
+			}
+			continue
+		}
+		name, value := strings.TrimSpace(l[:n]), strings.TrimSpace(l[n+1:])
+		if name == "Notes" {
+			notes = strings.Join(append([]string{value}, lines[i+1:]...), "\n")
+			break
+		}
+		if name == "Labels" && i == len(lines)-1 {
+			notes = l // sic2lp's labels, see reverseLabels
+			break
+		}
+		if value == "" || name == "Language" {
+			continue
+		}
+		fields = append(fields, safeincloud.Field{Name: name, FieldType: reverseFieldType(name), Value: value})
+	}
+	return nt, fields, notes
+}
+
+// reverseLabels removes the "Labels: " line that sic2lp appends to the notes
+// of every card, see importSite, and returns the labels listed in it.
+func reverseLabels(notes string) (string, []string) {
+	notes = strings.TrimSpace(strings.Replace(notes, "\r\n", "\n", -1))
+	n := strings.LastIndex(notes, "\n") + 1
+	if !strings.HasPrefix(notes[n:], "Labels: ") {
+		return notes, nil
+	}
+	var labels []string
+	for _, l := range strings.Split(strings.TrimPrefix(notes[n:], "Labels: "), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return strings.TrimSpace(notes[:n]), labels
+}
+
+// reverseFieldType returns the SafeInCloud field type for a field named
+// name, defaulting to text.
+func reverseFieldType(name string) string {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if t, ok := noteFieldTypes[key]; ok {
+		return t
+	}
+	if t, ok := fieldTypeHints[key]; ok {
+		return t
+	}
+	return "text"
+}
+
+// the SafeInCloud XML as written for import, see writeSafeInCloudXML.
+type sicXMLDatabase struct {
+	XMLName xml.Name      `xml:"database"`
+	Labels  []sicXMLLabel `xml:"label"`
+	Cards   []sicXMLCard  `xml:"card"`
+}
+
+type sicXMLLabel struct {
+	Name string `xml:"name,attr"`
+	ID   string `xml:"id,attr"`
+}
+
+type sicXMLCard struct {
+	Title    string        `xml:"title,attr"`
+	ID       string        `xml:"id,attr"`
+	Star     bool          `xml:"star,attr,omitempty"`
+	Fields   []sicXMLField `xml:"field"`
+	Notes    string        `xml:"notes,omitempty"`
+	LabelIDs []string      `xml:"label_id"`
+	Files    []sicXMLFile  `xml:"file"`
+}
+
+type sicXMLField struct {
+	Name  string `xml:"name,attr"`
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type sicXMLFile struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"` // base64
+}
+
+// writeSafeInCloudXML writes the database to filename in the XML format that
+// SafeInCloud exports and imports.
+func writeSafeInCloudXML(filename string, db *safeincloud.Database) error {
+	x := sicXMLDatabase{}
+	for _, l := range db.Labels {
+		x.Labels = append(x.Labels, sicXMLLabel{Name: l.Name, ID: l.ID})
+	}
+	for _, c := range db.Cards {
+		xc := sicXMLCard{Title: c.Title, ID: c.ID, Star: c.Star, Notes: c.Notes, LabelIDs: c.LabelIDs}
+		for _, f := range c.Fields {
+			xc.Fields = append(xc.Fields, sicXMLField{Name: f.Name, Type: f.FieldType, Value: f.Value})
+		}
+		for _, f := range c.Files {
+			xc.Files = append(xc.Files, sicXMLFile{Name: f.Name, Value: base64.StdEncoding.EncodeToString(f.Value)})
+		}
+		x.Cards = append(x.Cards, xc)
+	}
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(x); err != nil {
+			return errors.Wrap(err, "xml.Encode error")
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+}
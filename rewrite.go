@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// rewriteRules are the rules of the rewrite subcommand, read from YAML:
+//
+//	rename:
+//	  - from: Routing
+//	    to: Routing Number
+//	    label: Banking
+//	retype:
+//	  - field: PIN
+//	    from: text
+//	    to: password
+//	relabel:
+//	  - from: Bank
+//	    to: Banking
+//
+// Field names and labels are compared ignoring case.  A rename or retype with
+// a label only applies to cards with that label, and a retype with from only
+// to fields of that type.  A relabel to an existing label merges the two, and
+// a relabel without to removes the label from every card.
+type rewriteRules struct {
+	Rename  []renameRule  `yaml:"rename"`
+	Retype  []retypeRule  `yaml:"retype"`
+	Relabel []relabelRule `yaml:"relabel"`
+}
+
+type renameRule struct {
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Label string `yaml:"label"`
+}
+
+type retypeRule struct {
+	Field string `yaml:"field"`
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Label string `yaml:"label"`
+}
+
+type relabelRule struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// runRewrite runs the "rewrite" subcommand with args and returns the exit
+// code.
+//
+// Rewrite applies the rules to the SafeInCloud XML itself, so that the vault
+// can be cleaned up in bulk and imported back into SafeInCloud.  Everything
+// the rules do not touch is written back unchanged.
+func runRewrite(args []string) int {
+	fs := flag.NewFlagSet("rewrite", flag.ExitOnError)
+	var db, rulesFile, out string
+	fs.StringVar(&db, "db", "", "An Exported SafeInCloud.xml path and filename.")
+	fs.StringVar(&rulesFile, "rules", "", "A YAML file of rename, retype and relabel rules.")
+	fs.StringVar(&out, "o", "", "Output path and filename of the rewritten SafeInCloud XML.")
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s rewrite:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s rewrite -db /path/to/SafeInCloud_Export.xml -rules rename.yaml -o fixed.xml\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "\nAvailable flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if db == "" || rulesFile == "" || out == "" {
+		fs.Usage()
+		return 0
+	}
+	if out == db {
+		fmt.Fprintln(os.Stderr, "-o must not overwrite -db, keep the original export until the rewrite is imported")
+		return 2
+	}
+
+	rules, err := readRewriteRules(rulesFile)
+	if err != nil {
+		logger.Error("unable to read -rules", "err", err)
+		return 2
+	}
+	handleInterrupts()
+
+	f, err := os.Open(db)
+	if err != nil {
+		logger.Error("unable to open SafeInCloud export", "err", err)
+		return 10
+	}
+	defer f.Close()
+	root, err := readXMLTree(f)
+	if err != nil {
+		logger.Error("unable to parse SafeInCloud export", "err", err)
+		return 10
+	}
+	if root.name.Local != "database" {
+		logger.Error("unable to parse SafeInCloud export", "err", errors.Errorf("root element is <%s>, not <database>", root.name.Local))
+		return 10
+	}
+
+	rewrite(root, rules)
+
+	if err := writeFileAtomic(out, func(w io.Writer) error {
+		return writeXMLTree(w, root)
+	}); err != nil {
+		logger.Error("unable to write rewritten SafeInCloud XML", "err", err)
+		return 12
+	}
+	return 0
+}
+
+// readRewriteRules reads and validates the YAML rules in filename.
+func readRewriteRules(filename string) (*rewriteRules, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile error")
+	}
+	rules := &rewriteRules{}
+	if err := yaml.Unmarshal(b, rules); err != nil {
+		return nil, errors.Wrap(err, "yaml.Unmarshal error")
+	}
+	for i, r := range rules.Rename {
+		if r.From == "" || r.To == "" {
+			return nil, errors.Errorf("rename rule %d needs both from and to", i+1)
+		}
+	}
+	for i, r := range rules.Retype {
+		if r.Field == "" || r.To == "" {
+			return nil, errors.Errorf("retype rule %d needs both field and to", i+1)
+		}
+	}
+	for i, r := range rules.Relabel {
+		if r.From == "" {
+			return nil, errors.Errorf("relabel rule %d needs from", i+1)
+		}
+	}
+	return rules, nil
+}
+
+// rewrite applies the rules to the database in place.  Renames and retypes
+// are applied first, so their labels are the labels of the original export.
+func rewrite(db *xmlNode, rules *rewriteRules) {
+	labels := map[string]string{} // id -> name
+	for _, l := range db.childrenNamed("label") {
+		labels[l.attr("id")] = l.attr("name")
+	}
+	hasLabel := func(card *xmlNode, name string) bool {
+		if name == "" {
+			return true
+		}
+		for _, id := range card.childrenNamed("label_id") {
+			if strings.EqualFold(labels[strings.TrimSpace(id.text)], name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	renamed := make([]int, len(rules.Rename))
+	retyped := make([]int, len(rules.Retype))
+	for _, card := range db.childrenNamed("card") {
+		for _, f := range card.childrenNamed("field") {
+			for i, r := range rules.Rename {
+				if strings.EqualFold(strings.TrimSpace(f.attr("name")), r.From) && hasLabel(card, r.Label) {
+					logV(5, "renaming field", "card", card.attr("id"), "field", f.attr("name"), "to", r.To)
+					f.setAttr("name", r.To)
+					renamed[i]++
+					break
+				}
+			}
+			for i, r := range rules.Retype {
+				if strings.EqualFold(strings.TrimSpace(f.attr("name")), r.Field) &&
+					(r.From == "" || r.From == f.attr("type")) && hasLabel(card, r.Label) {
+					logV(5, "retyping field", "card", card.attr("id"), "field", f.attr("name"), "type", f.attr("type"), "to", r.To)
+					f.setAttr("type", r.To)
+					retyped[i]++
+					break
+				}
+			}
+		}
+	}
+	for i, r := range rules.Rename {
+		logRewriteRule("rename", r.From+" -> "+r.To, renamed[i])
+	}
+	for i, r := range rules.Retype {
+		logRewriteRule("retype", r.Field+" -> "+r.To, retyped[i])
+	}
+
+	for _, r := range rules.Relabel {
+		logRewriteRule("relabel", r.From+" -> "+r.To, relabel(db, r))
+	}
+}
+
+// relabel applies a single relabel rule and returns the number of cards it
+// changed.
+func relabel(db *xmlNode, r relabelRule) int {
+	var from, to *xmlNode
+	for _, l := range db.childrenNamed("label") {
+		switch {
+		case strings.EqualFold(l.attr("name"), r.From):
+			from = l
+		case r.To != "" && strings.EqualFold(l.attr("name"), r.To):
+			to = l
+		}
+	}
+	if from == nil {
+		return 0
+	}
+	fromID := from.attr("id")
+
+	var cards int
+	for _, card := range db.childrenNamed("card") {
+		for _, id := range card.childrenNamed("label_id") {
+			if strings.TrimSpace(id.text) == fromID {
+				cards++
+			}
+		}
+	}
+
+	// a label that is only renamed keeps its id.
+	if to == nil && r.To != "" {
+		from.setAttr("name", r.To)
+		return cards
+	}
+
+	// otherwise the label is removed, and its cards moved to the existing label.
+	db.removeChild(from)
+	for _, card := range db.childrenNamed("card") {
+		ids := card.childrenNamed("label_id")
+		var hasTo bool
+		for _, id := range ids {
+			hasTo = hasTo || (to != nil && strings.TrimSpace(id.text) == to.attr("id"))
+		}
+		for _, id := range ids {
+			if strings.TrimSpace(id.text) != fromID {
+				continue
+			}
+			if to == nil || hasTo {
+				card.removeChild(id)
+				continue
+			}
+			id.text = to.attr("id")
+			hasTo = true
+		}
+	}
+	return cards
+}
+
+// logRewriteRule logs how many times a rule applied.  A rule that never
+// applies is most likely a typo.
+func logRewriteRule(kind, rule string, n int) {
+	if n == 0 {
+		logger.Warn("rule matched nothing", "rule", kind, "change", rule)
+		return
+	}
+	logger.Info("rule applied", "rule", kind, "change", rule, "count", n)
+}
+
+// xmlNode is an element of an XML document kept as a tree, so that a
+// SafeInCloud XML can be changed without losing any attributes or elements
+// that the safeincloud package does not know about.
+//
+// Text is only kept for elements without child elements; the whitespace
+// between elements is replaced by indentation when written.
+type xmlNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	text     string
+	children []*xmlNode
+}
+
+// attr returns the value of the attribute called name.
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// setAttr sets the attribute called name, adding it if needed.
+func (n *xmlNode) setAttr(name, value string) {
+	for i, a := range n.attrs {
+		if a.Name.Local == name {
+			n.attrs[i].Value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// childrenNamed returns the child elements called name, in order.
+func (n *xmlNode) childrenNamed(name string) []*xmlNode {
+	var nodes []*xmlNode
+	for _, c := range n.children {
+		if c.name.Local == name {
+			nodes = append(nodes, c)
+		}
+	}
+	return nodes
+}
+
+// removeChild removes the child element c.
+func (n *xmlNode) removeChild(c *xmlNode) {
+	for i, child := range n.children {
+		if child == c {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// readXMLTree reads an XML document into a tree and returns its root.
+func readXMLTree(r io.Reader) (*xmlNode, error) {
+	dec := xml.NewDecoder(r)
+	var stack []*xmlNode
+	var root *xmlNode
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "xml.Token error")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name, attrs: t.Copy().Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if root == nil {
+		return nil, errors.New("document is empty")
+	}
+	return root, nil
+}
+
+// writeXMLTree writes the tree below root as an indented XML document.
+func writeXMLTree(w io.Writer, root *xmlNode) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := encodeXMLNode(enc, root); err != nil {
+		return errors.Wrap(err, "xml.EncodeToken error")
+	}
+	if err := enc.Flush(); err != nil {
+		return errors.Wrap(err, "xml.Flush error")
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// encodeXMLNode writes n and its children to enc.
+func encodeXMLNode(enc *xml.Encoder, n *xmlNode) error {
+	start := xml.StartElement{Name: n.name, Attr: n.attrs}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if len(n.children) == 0 && n.text != "" {
+		if err := enc.EncodeToken(xml.CharData(n.text)); err != nil {
+			return err
+		}
+	}
+	for _, c := range n.children {
+		if err := encodeXMLNode(enc, c); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/eduncan911/safeincloud"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+)
+
+// passwordFD is the file descriptor to read the master password of an
+// encrypted SafeInCloud database from, or -1 to prompt for it.
+var passwordFD int
+
+// passwordFlag registers "-password-fd" with fs, for every command that
+// reads a SafeInCloud database.
+func passwordFlag(fs *flag.FlagSet) {
+	fs.IntVar(&passwordFD, "password-fd", -1, "Read the master password of an encrypted SafeInCloud .db from this file descriptor instead of prompting.")
+}
+
+// parseDatabase parses the SafeInCloud database in filename, which is either
+// an XML export or SafeInCloud's own encrypted .db file.
+//
+// The .db file is decrypted in memory with the master password, so that no
+// plaintext copy of the database is ever written to disk.
+func parseDatabase(filename string) (*safeincloud.Database, error) {
+	db, _, err := parseDatabaseXML(filename)
+	return db, err
+}
+
+// parseDatabaseXML is parseDatabase, but also returns the XML of the
+// database, for what the safeincloud package does not parse.
+func parseDatabaseXML(filename string) (*safeincloud.Database, []byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "ioutil.ReadFile error")
+	}
+	if !isEncryptedDatabase(b) {
+		db, err := safeincloud.ParseFile(filename)
+		return db, b, err
+	}
+
+	password, err := readMasterPassword()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "readMasterPassword error")
+	}
+	data, err := decryptDatabase(b, password)
+	for i := range password {
+		password[i] = 0
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "decryptDatabase error")
+	}
+
+	// the decrypted database is the same XML as an export.
+	db := &safeincloud.Database{}
+	if err := xml.Unmarshal(data, db); err != nil {
+		return nil, nil, errors.Wrap(err, "xml.Unmarshal error")
+	}
+	return db, data, nil
+}
+
+// isEncryptedDatabase returns true unless b looks like an XML document.
+func isEncryptedDatabase(b []byte) bool {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")) // UTF-8 BOM
+	b = bytes.TrimLeft(b, " \t\r\n")
+	return len(b) == 0 || b[0] != '<'
+}
+
+// readMasterPassword reads the master password from passwordFD, or prompts
+// for it on the terminal without echoing it.
+func readMasterPassword() ([]byte, error) {
+	if passwordFD >= 0 {
+		f := os.NewFile(uintptr(passwordFD), "password-fd")
+		if f == nil {
+			return nil, errors.Errorf("-password-fd %d is not a valid file descriptor", passwordFD)
+		}
+		defer f.Close()
+		line, err := bufio.NewReader(f).ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "-password-fd read error")
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("the database is encrypted and stdin is not a terminal, use -password-fd")
+	}
+	fmt.Fprint(os.Stderr, "SafeInCloud master password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, errors.Wrap(err, "term.ReadPassword error")
+	}
+	return password, nil
+}
+
+// decryptDatabase decrypts a SafeInCloud .db file with the master password
+// and returns the XML it holds.
+//
+// The file is a 2 byte magic and a 1 byte version, followed by the salt, IV,
+// a second salt and the encrypted key block, each prefixed by its length in a
+// single byte.  The master password and salt derive, with PBKDF2-SHA1 and
+// 10000 iterations, the AES-256 key of the key block.  The key block holds
+// the IV and key of the database itself, and a check of that key derived with
+// the second salt, which tells a wrong password apart.  The rest of the file
+// is the zlib compressed XML, encrypted with AES-256-CBC.
+func decryptDatabase(b []byte, password []byte) ([]byte, error) {
+	r := bytes.NewReader(b)
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("file is too short to be a SafeInCloud database")
+	}
+	salt, err := readShortBytes(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "salt")
+	}
+	iv, err := readShortBytes(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "iv")
+	}
+	salt2, err := readShortBytes(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "salt2")
+	}
+	block, err := readShortBytes(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "key block")
+	}
+
+	key := pbkdf2.Key(password, salt, 10000, 32, sha1.New)
+	keyBlock, err := decryptCBC(key, iv, block)
+	if errors.Cause(err) == errBadPadding {
+		// a wrong key decrypts to garbage, which is rarely padded right.
+		return nil, errors.New("wrong master password")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "key block")
+	}
+	kr := bytes.NewReader(keyBlock)
+	iv2, err := readShortBytes(kr)
+	if err != nil {
+		return nil, errors.New("wrong master password")
+	}
+	key2, err := readShortBytes(kr)
+	if err != nil {
+		return nil, errors.New("wrong master password")
+	}
+	check, err := readShortBytes(kr)
+	if err != nil || !hmac.Equal(check, pbkdf2.Key(key2, salt2, 1000, 32, sha1.New)) {
+		return nil, errors.New("wrong master password")
+	}
+
+	rest := b[len(b)-r.Len():]
+	compressed, err := decryptCBC(key2, iv2, rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "database")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "zlib.NewReader error")
+	}
+	defer zr.Close()
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrap(err, "zlib read error")
+	}
+	return data, nil
+}
+
+// readShortBytes reads a byte slice prefixed by its length in a single byte.
+func readShortBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.New("unexpected end of file")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.New("unexpected end of file")
+	}
+	return b, nil
+}
+
+// errBadPadding is returned by decryptCBC if the decrypted data does not end
+// in valid PKCS#7 padding, as when decrypted with the wrong key.
+var errBadPadding = errors.New("invalid padding")
+
+// decryptCBC decrypts data with AES-CBC and removes its PKCS#7 padding.
+func decryptCBC(key, iv, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes.NewCipher error")
+	}
+	if len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("not a multiple of the AES block size")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(out, data)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errBadPadding
+	}
+	for _, p := range out[len(out)-pad:] {
+		if int(p) != pad {
+			return nil, errBadPadding
+		}
+	}
+	return out[:len(out)-pad], nil
+}
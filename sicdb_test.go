@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptCBC encrypts data with AES-CBC after adding PKCS#7 padding, the
+// reverse of decryptCBC.
+func encryptCBC(t *testing.T, key, iv, data []byte) []byte {
+	t.Helper()
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(c, iv).CryptBlocks(out, data)
+	return out
+}
+
+// shortBytes prefixes b with its length in a single byte, the reverse of
+// readShortBytes.
+func shortBytes(b []byte) []byte {
+	return append([]byte{byte(len(b))}, b...)
+}
+
+// encryptDatabase encrypts xml with password into the layout that
+// decryptDatabase reads, with fixed salts, IVs and keys.
+func encryptDatabase(t *testing.T, xml, password []byte) []byte {
+	t.Helper()
+	salt := bytes.Repeat([]byte{1}, 16)
+	iv := bytes.Repeat([]byte{2}, aes.BlockSize)
+	salt2 := bytes.Repeat([]byte{3}, 16)
+	iv2 := bytes.Repeat([]byte{4}, aes.BlockSize)
+	key2 := bytes.Repeat([]byte{5}, 32)
+
+	var keyBlock []byte
+	keyBlock = append(keyBlock, shortBytes(iv2)...)
+	keyBlock = append(keyBlock, shortBytes(key2)...)
+	keyBlock = append(keyBlock, shortBytes(pbkdf2.Key(key2, salt2, 1000, 32, sha1.New))...)
+	key := pbkdf2.Key(password, salt, 10000, 32, sha1.New)
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(xml); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := []byte{0x05, 0x05, 0x01}
+	b = append(b, shortBytes(salt)...)
+	b = append(b, shortBytes(iv)...)
+	b = append(b, shortBytes(salt2)...)
+	b = append(b, shortBytes(encryptCBC(t, key, iv, keyBlock))...)
+	return append(b, encryptCBC(t, key2, iv2, compressed.Bytes())...)
+}
+
+func TestDecryptDatabase(t *testing.T) {
+	xml := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<database><card title="Google" id="10"><field name="Password" type="password">secret</field></card></database>`)
+	b := encryptDatabase(t, xml, []byte("correct horse"))
+	if !isEncryptedDatabase(b) {
+		t.Fatal("encrypted database taken for XML")
+	}
+
+	got, err := decryptDatabase(b, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, xml) {
+		t.Errorf("decrypted %q, want %q", got, xml)
+	}
+
+	for _, pw := range []string{"", "wrong", "correct horse "} {
+		if _, err := decryptDatabase(b, []byte(pw)); err == nil || !strings.Contains(err.Error(), "wrong master password") {
+			t.Errorf("password %q: error %v, want wrong master password", pw, err)
+		}
+	}
+
+	if _, err := decryptDatabase(b[:20], []byte("correct horse")); err == nil {
+		t.Error("no error for a truncated database")
+	}
+}
+
+func TestDecryptCBCPadding(t *testing.T) {
+	key := bytes.Repeat([]byte{6}, 32)
+	iv := bytes.Repeat([]byte{7}, aes.BlockSize)
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, last := range map[string][]byte{
+		"zero":          {0},
+		"too long":      {aes.BlockSize + 1},
+		"inconsistent":  {4, 3, 4, 4},
+		"only last set": {1, 1, 1, 9, 3},
+	} {
+		plain := append(bytes.Repeat([]byte{'x'}, aes.BlockSize-len(last)), last...)
+		data := make([]byte, len(plain))
+		cipher.NewCBCEncrypter(c, iv).CryptBlocks(data, plain)
+		if _, err := decryptCBC(key, iv, data); err != errBadPadding {
+			t.Errorf("%s: error %v, want %v", name, err, errBadPadding)
+		}
+	}
+
+	want := []byte("padded right")
+	got, err := decryptCBC(key, iv, encryptCBC(t, key, iv, want))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("decrypted %q, %v, want %q", got, err, want)
+	}
+}
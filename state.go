@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// stateVersion is the version of the state JSON written by "-state", see
+// vaultVersion.
+const stateVersion = 2
+
+// removedCardsCSV is the csv the cards removed since "-since-state" are
+// listed in.
+const removedCardsCSV = "removed_cards.csv"
+
+// runState is the state of a run, written by "-state" and read back by
+// "-since-state" to only convert what changed since.
+type runState struct {
+	Version int         `json:"version"`
+	Cards   []stateCard `json:"cards"`
+}
+
+// stateCard is a single card as it was last converted.  SHA256 is the hash
+// of its entries, see cardHash.
+//
+// Written are the formats the card was written to as of SHA256, so that the
+// next run converts it again for any other format: one it failed for with
+// "-keep-going", or one not selected until then.
+type stateCard struct {
+	ID      string   `json:"id"`
+	SHA256  string   `json:"sha256"`
+	Title   string   `json:"title"`
+	Folder  string   `json:"folder"`
+	Written []string `json:"written,omitempty"`
+}
+
+// cardHash returns the hash of the content of a card: every entry it was
+// converted to, including its attachments.  Anything that changes the output
+// of the card changes its hash, including the folder picked by "-p".
+func cardHash(entries []entry) (string, error) {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return "", errors.Wrap(err, "json.Marshal error")
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readState reads the state written by an earlier run, by card ID.
+//
+// Version 1 did not record the formats of a card, so its cards are taken to
+// be written to every one of formats, the formats of this run.
+func readState(filename string, formats []string) (map[string]stateCard, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile error")
+	}
+	var s runState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal error")
+	}
+	if s.Version < 1 || s.Version > stateVersion {
+		return nil, errors.Errorf("unsupported state version %d, this build reads up to version %d", s.Version, stateVersion)
+	}
+	cards := map[string]stateCard{}
+	for _, c := range s.Cards {
+		if s.Version < 2 {
+			c.Written = append([]string{}, formats...)
+		}
+		cards[c.ID] = c
+	}
+	return cards, nil
+}
+
+// removedSince returns the cards of the earlier state that are no longer in
+// cards, ordered by ID.  cards must be every card of this run, before any
+// filter, or filtered cards would be reported as removed.
+func removedSince(cards [][]entry, prev map[string]stateCard) []stateCard {
+	ids := map[string]bool{}
+	for _, entries := range cards {
+		ids[entries[0].CardID] = true
+	}
+	var removed []stateCard
+	for id, c := range prev {
+		if !ids[id] {
+			removed = append(removed, c)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].ID < removed[j].ID })
+	return removed
+}
+
+// changedSince returns the cards that are new or changed since the earlier
+// state, or unchanged but not yet written to one of formats, the formats of
+// this run, in order, and the number of cards left out as unchanged.
+func changedSince(cards [][]entry, hashes map[string]string, prev map[string]stateCard, formats []string) ([][]entry, int) {
+	var changed [][]entry
+	var unchanged int
+	for _, entries := range cards {
+		c := entries[0]
+		p, ok := prev[c.CardID]
+		if ok && p.SHA256 == hashes[c.CardID] {
+			if missing := missingFormats(p, formats); len(missing) > 0 {
+				logger.Info("card unchanged since -since-state, converting it for the formats it is missing from", "card", c.CardID, "formats", strings.Join(missing, ","))
+				changed = append(changed, entries)
+				continue
+			}
+			logV(3, "card unchanged since -since-state", "card", c.CardID)
+			unchanged++
+			continue
+		}
+		if ok {
+			// LastPass imports it as a new entry next to the old one.
+			logger.Warn("card changed since -since-state, replace the old entry", "card", c.CardID, "folder", p.Folder)
+		}
+		changed = append(changed, entries)
+	}
+	return changed, unchanged
+}
+
+// missingFormats returns the formats the card of the earlier state was not
+// written to.
+func missingFormats(p stateCard, formats []string) []string {
+	var missing []string
+	for _, f := range formats {
+		if !containsString(p.Written, f) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// writeState writes the state of the cards to filename, ordered by ID.
+func writeState(filename string, cards map[string]stateCard) error {
+	s := runState{Version: stateVersion, Cards: []stateCard{}}
+	for _, c := range cards {
+		s.Cards = append(s.Cards, c)
+	}
+	sort.Slice(s.Cards, func(i, j int) bool { return s.Cards[i].ID < s.Cards[j].ID })
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s); err != nil {
+			return errors.Wrap(err, "json.Encode error")
+		}
+		return nil
+	})
+}
+
+// writeRemovedCSV lists the removed cards in a csv, to delete them by hand
+// from the new password manager.  Every cell is neutralized with safeCell, as
+// it is only meant to be read.
+func writeRemovedCSV(filename string, removed []stateCard) error {
+	var rows [][]string
+	for _, c := range removed {
+		rows = append(rows, []string{c.ID, c.Title, c.Folder})
+	}
+	return writeCSV(filename, []string{"card_id", "title", "folder"}, rows, true)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/eduncan911/safeincloud"
+	"github.com/pkg/errors"
+)
+
+// templatesVersion is the version of the template definition JSON written by
+// the templates subcommand, see vaultVersion.
+const templatesVersion = 1
+
+// templateFile is the template definition JSON written by the templates
+// subcommand and read back with "-templates".
+type templateFile struct {
+	Version   int           `json:"version"`
+	Templates []templateDef `json:"templates"`
+}
+
+// templateDef describes a SafeInCloud template: its fields and types, and the
+// LastPass NoteType and field names that the cards created from it map to.
+//
+// NoteType and LastPassField are guessed by the templates subcommand, and
+// meant to be corrected by hand before converting with "-templates".
+type templateDef struct {
+	ID       string          `json:"id"`
+	Title    string          `json:"title"`
+	NoteType string          `json:"note_type"`
+	Fields   []templateField `json:"fields"`
+}
+
+type templateField struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	LastPassField string `json:"lastpass_field"`
+}
+
+// runTemplates runs the "templates" subcommand with args and returns the exit
+// code.
+//
+// Templates writes the definition of every template in the database to -o,
+// and a report of them and the cards created from them to stdout.
+func runTemplates(args []string) int {
+	fs := flag.NewFlagSet("templates", flag.ExitOnError)
+	var db, out string
+	fs.StringVar(&db, "db", "", "An Exported SafeInCloud.xml, or the encrypted SafeInCloud.db, path and filename.")
+	fs.StringVar(&out, "o", "templates.json", "Output path and filename of the template definitions.")
+	passwordFlag(fs)
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s templates:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s templates -db /path/to/SafeInCloud_Export.xml -o templates.json\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "\nAvailable flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if db == "" {
+		fs.Usage()
+		return 0
+	}
+	handleInterrupts()
+
+	sic, data, err := parseDatabaseXML(db)
+	if err != nil {
+		logger.Error("unable to parse SafeInCloud export", "err", err)
+		return 10
+	}
+	meta, err := readCardMeta(data)
+	if err != nil {
+		logger.Error("unable to parse SafeInCloud export", "err", err)
+		return 10
+	}
+	defs := templateDefinitions(sic)
+	if err := writeTemplates(out, defs); err != nil {
+		logger.Error("unable to write template definitions", "err", err)
+		return 12
+	}
+	if err := writeTemplatesReport(os.Stdout, defs, sic, meta); err != nil {
+		logger.Error("unable to write report", "err", err)
+		return 12
+	}
+	return 0
+}
+
+// templateDefinitions returns the definition of every template in the
+// database that is not deleted.
+func templateDefinitions(db *safeincloud.Database) []templateDef {
+	defs := []templateDef{}
+	for _, c := range db.Cards {
+		if !c.Template || c.Deleted {
+			continue
+		}
+		d := templateDef{ID: c.ID, Title: c.Title, NoteType: guessNoteType(db, c)}
+		for _, f := range c.Fields {
+			tf := templateField{Name: f.Name, Type: f.FieldType}
+			for _, name := range noteTypeFields[d.NoteType] {
+				if strings.EqualFold(strings.TrimSpace(f.Name), name) {
+					tf.LastPassField = name
+					break
+				}
+			}
+			d.Fields = append(d.Fields, tf)
+		}
+		defs = append(defs, d)
+	}
+	return defs
+}
+
+// guessNoteType returns the LastPass NoteType a template most likely is, by
+// its title ("Bank Account") or by one of its labels ("Banking").
+func guessNoteType(db *safeincloud.Database, c safeincloud.Card) string {
+	for nt := range noteTypeFields {
+		if strings.EqualFold(strings.TrimSpace(c.Title), nt) {
+			return nt
+		}
+	}
+	for _, l := range append([]string{c.Title}, cardLabels(db, c)...) {
+		for label, nt := range noteTypes {
+			if strings.EqualFold(strings.TrimSpace(l), label) {
+				return nt
+			}
+		}
+	}
+	return ""
+}
+
+// writeTemplates writes the template definitions as JSON to filename.
+func writeTemplates(filename string, defs []templateDef) error {
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(templateFile{Version: templatesVersion, Templates: defs}); err != nil {
+			return errors.Wrap(err, "json.Encode error")
+		}
+		return nil
+	})
+}
+
+// writeTemplatesReport writes every template for humans: its NoteType, where
+// each of its fields ends up at LastPass, and the cards created from it.
+func writeTemplatesReport(w io.Writer, defs []templateDef, db *safeincloud.Database, meta map[string]cardMeta) error {
+	counts := map[string]int{}
+	for _, c := range db.Cards {
+		if c.Template || c.Deleted {
+			continue
+		}
+		var fields []entryField
+		for _, f := range c.Fields {
+			fields = append(fields, entryField{Name: f.Name})
+		}
+		if d := cardTemplate(defs, meta[c.ID].TemplateID, fields); d != nil {
+			counts[d.ID]++
+		}
+	}
+
+	for _, d := range defs {
+		nt := "no NoteType, a generic Secure Note"
+		if d.NoteType != "" {
+			nt = fmt.Sprintf("NoteType %q", d.NoteType)
+		}
+		if _, err := fmt.Fprintf(w, "%s %q: %s, %d card(s) created from it\n", d.ID, d.Title, nt, counts[d.ID]); err != nil {
+			return err
+		}
+		for _, f := range d.Fields {
+			to := "kept in the notes"
+			if f.LastPassField != "" {
+				to = fmt.Sprintf("LastPass field %q", f.LastPassField)
+			}
+			if _, err := fmt.Fprintf(w, "  %s (%s): %s\n", f.Name, f.Type, to); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d template(s)\n", len(defs))
+	return err
+}
+
+// readTemplates reads the template definitions in filename, written by the
+// templates subcommand and possibly edited since.
+func readTemplates(filename string) ([]templateDef, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile error")
+	}
+	var t templateFile
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal error")
+	}
+	if t.Version < 1 || t.Version > templatesVersion {
+		return nil, errors.Errorf("unsupported templates version %d, this build reads up to version %d", t.Version, templatesVersion)
+	}
+	for _, d := range t.Templates {
+		if d.NoteType == "" {
+			continue
+		}
+		if _, ok := noteTypeFields[d.NoteType]; !ok {
+			var known []string
+			for nt := range noteTypeFields {
+				known = append(known, nt)
+			}
+			sort.Strings(known)
+			return nil, errors.Errorf("template %s: unknown note_type %q, must be one of: %s", d.ID, d.NoteType, strings.Join(known, ", "))
+		}
+	}
+	return t.Templates, nil
+}
+
+// cardTemplate returns the template a card was created from: the one of
+// templateID if the export records it, whether or not it is among defs, or
+// else the one matched by the card's fields.
+func cardTemplate(defs []templateDef, templateID string, fields []entryField) *templateDef {
+	if templateID == "" {
+		return matchTemplate(defs, fields)
+	}
+	for i, d := range defs {
+		if d.ID == templateID {
+			return &defs[i]
+		}
+	}
+	return nil
+}
+
+// matchTemplate returns the template the fields were most likely created
+// from: the template with the most fields whose fields all appear in fields,
+// ignoring case.  It returns nil if no template matches.
+func matchTemplate(defs []templateDef, fields []entryField) *templateDef {
+	names := map[string]bool{}
+	for _, f := range fields {
+		names[strings.ToLower(strings.TrimSpace(f.Name))] = true
+	}
+	var best *templateDef
+	for i, d := range defs {
+		if len(d.Fields) == 0 || (best != nil && len(d.Fields) <= len(best.Fields)) {
+			continue
+		}
+		match := true
+		for _, f := range d.Fields {
+			if !names[strings.ToLower(strings.TrimSpace(f.Name))] {
+				match = false
+				break
+			}
+		}
+		if match {
+			best = &defs[i]
+		}
+	}
+	return best
+}
+
+// applyTemplates gives every Secure Note created from one of the templates
+// the template's NoteType, and renames its fields to their LastPass field
+// names, so that they are filled in at LastPass instead of ending up in the
+// notes.  A template's NoteType overrides the one of the card's folder.
+//
+// Deleted cards archived with "-deleted archive" are left as they are, as they
+// are only kept for reference in the archive folder.
+func applyTemplates(cards [][]entry, defs []templateDef) {
+	for _, entries := range cards {
+		for i := range entries {
+			e := &entries[i]
+			if e.Kind != entryNote || e.Deleted {
+				continue
+			}
+			d := cardTemplate(defs, e.Template, e.Fields)
+			if d == nil {
+				continue
+			}
+			logV(5, "created from template", "card", e.CardID, "template", d.Title, "note_type", d.NoteType)
+			if d.NoteType != "" {
+				e.NoteType = d.NoteType
+			}
+			for j := range e.Fields {
+				f := &e.Fields[j]
+				for _, tf := range d.Fields {
+					if tf.LastPassField != "" && strings.EqualFold(strings.TrimSpace(f.Name), strings.TrimSpace(tf.Name)) {
+						f.Name = tf.LastPassField
+						break
+					}
+				}
+			}
+		}
+	}
+}
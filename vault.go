@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/eduncan911/safeincloud"
+	"github.com/pkg/errors"
+)
+
+// vaultVersion is the version of the vault JSON schema written by dump.  It
+// must be bumped whenever a field of vault, vaultCard or entry changes
+// meaning, and readVault refuses anything newer than it understands.
+const vaultVersion = 4
+
+// vault is the format-neutral intermediate JSON written by the dump
+// subcommand and read back with "-vault".
+//
+// It holds the cards exactly as every exporter would receive them, after the
+// classification into sites and notes and the choice of folder, so that it
+// can be edited by hand or by a script before being converted.
+type vault struct {
+	Version int         `json:"version"`
+	Cards   []vaultCard `json:"cards"`
+}
+
+// vaultCard is a single SafeInCloud card and the entries it was converted to.
+// The entries of a card are always added to an exporter together.
+type vaultCard struct {
+	ID      string  `json:"id"`
+	Entries []entry `json:"entries"`
+}
+
+// deletedOptions is what to do with the cards in SafeInCloud's trash.
+type deletedOptions struct {
+	mode   string
+	folder string
+}
+
+// deletedFlags registers "-deleted" and "-deleted-folder" with fs, for every
+// command that converts cards, and returns the options they set.
+func deletedFlags(fs *flag.FlagSet) *deletedOptions {
+	d := &deletedOptions{}
+	fs.StringVar(&d.mode, "deleted", "skip", "What to do with deleted cards: skip, or archive as Secure Notes in -deleted-folder.")
+	fs.StringVar(&d.folder, "deleted-folder", `Archive\Deleted in SafeInCloud`, "Folder of the deleted cards archived by -deleted archive.")
+	return d
+}
+
+// archiveFolder returns the folder to archive deleted cards into, or an empty
+// string to skip them.
+func (d *deletedOptions) archiveFolder() (string, error) {
+	switch d.mode {
+	case "skip":
+		return "", nil
+	case "archive":
+		if d.folder == "" {
+			return "", errors.New("-deleted archive needs a -deleted-folder")
+		}
+		return d.folder, nil
+	}
+	return "", errors.Errorf("unknown -deleted %q, must be skip or archive", d.mode)
+}
+
+// parseCards converts every card of the database to its entries, skipping
+// templates, deleted or not, and deleted cards unless archive is set.  The returned slices are
+// in the order of the cards in the database, one per card.
+//
+// Deleted cards are archived as a single Secure Note each in the archive
+// folder, whatever they were, as old credentials are only kept for reference.
+func parseCards(db *safeincloud.Database, pf []string, df, archive string) (cards [][]entry, deleted, skipped int) {
+	for _, c := range db.Cards {
+		// a template is never a card, even once deleted.
+		if c.Template {
+			logger.Info("skipping template", "card", c.ID)
+			skipped++
+			continue
+		}
+		if c.Deleted && archive != "" {
+			logger.Info("archiving deleted card", "card", c.ID, "folder", archive)
+			cards = append(cards, archiveCard(db, c, pf, df, archive))
+			continue
+		}
+		if c.Deleted {
+			logger.Info("skipping deleted card", "card", c.ID)
+			deleted++
+			continue
+		}
+		cards = append(cards, parse(db, c, pf, df))
+	}
+	return cards, deleted, skipped
+}
+
+// archiveCard converts a deleted card to a Secure Note in the archive folder.
+// Its original labels are kept, and noted by the exporters that have no
+// folders of their own.
+func archiveCard(db *safeincloud.Database, c safeincloud.Card, pf []string, df, archive string) []entry {
+	title := c.Title
+	if title == "" {
+		title = "SecureNote " + c.ID
+	}
+	e := newEntry(db, c, pf, df, entryNote, title)
+	e.Folder = archive
+	e.Deleted = true
+	return []entry{e}
+}
+
+// runDump runs the "dump" subcommand with args and returns the exit code.
+func runDump(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var db, pfRaw, df, out, attachments, templatesFile string
+	fs.StringVar(&db, "db", "", "An Exported SafeInCloud.xml, or the encrypted SafeInCloud.db, path and filename.")
+	fs.StringVar(&df, "f", "Imported", "Default folder of unlabelled cards.")
+	fs.StringVar(&pfRaw, "p", "", "Priority folder of labels to assign in order (comma delimited).")
+	fs.StringVar(&out, "o", "vault.json", "Output path and filename of the vault JSON.")
+	fs.StringVar(&attachments, "attachments", "inline", "How to write attachments: inline (base64) or files (next to -o).")
+	fs.StringVar(&templatesFile, "templates", "", "Template definitions written by the templates subcommand, to map the cards created from a template to its NoteType.")
+	passwordFlag(fs)
+	filter := filterFlags(fs)
+	del := deletedFlags(fs)
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s dump:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s dump -db /path/to/SafeInCloud_Export.xml -o vault.json [options]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "\nAvailable flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if db == "" {
+		fs.Usage()
+		return 0
+	}
+	if attachments != "inline" && attachments != "files" {
+		fmt.Fprintf(os.Stderr, "unknown -attachments %q, must be inline or files\n", attachments)
+		return 2
+	}
+	if err := filter.compile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	archive, err := del.archiveFolder()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var templates []templateDef
+	if templatesFile != "" {
+		if templates, err = readTemplates(templatesFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	var pf []string
+	if pfRaw != "" {
+		pf = strings.Split(pfRaw, ",")
+	}
+	handleInterrupts()
+
+	sic, data, err := parseDatabaseXML(db)
+	if err != nil {
+		logger.Error("unable to parse SafeInCloud export", "err", err)
+		return 10
+	}
+	meta, err := readCardMeta(data)
+	if err != nil {
+		logger.Error("unable to parse SafeInCloud export", "err", err)
+		return 10
+	}
+	cards, deleted, skipped := parseCards(sic, pf, df, archive)
+	applyMetadata(cards, meta)
+	applyTemplates(cards, templates)
+	cards, filtered := filter.apply(cards)
+	if err := writeVault(out, cards, attachments == "files"); err != nil {
+		logger.Error("unable to write vault", "err", err)
+		return 12
+	}
+	logger.Info("totals", "dumped", len(cards), "deleted", deleted, "skipped", skipped, "filtered", filtered)
+	return 0
+}
+
+// writeVault writes the cards as vault JSON to filename.
+//
+// If files is set, attachments are written to a directory named after
+// filename (vault.json writes to vault_files/) and referenced by their path
+// relative to filename, instead of being inlined as base64.
+//
+// Entries of the same card share their attachments, so they are only written
+// to the first entry of the card, see readVault.
+func writeVault(filename string, cards [][]entry, files bool) error {
+	v := vault{Version: vaultVersion, Cards: []vaultCard{}}
+	dir := strings.TrimSuffix(filename, filepath.Ext(filename)) + "_files"
+	for _, entries := range cards {
+		vc := vaultCard{ID: entries[0].CardID}
+		for i, e := range entries {
+			switch {
+			case i > 0:
+				e.Attachments = nil
+			case files:
+				as, err := vaultAttachments(dir, filepath.Dir(filename), e)
+				if err != nil {
+					return errors.Wrap(err, "vaultAttachments error")
+				}
+				e.Attachments = as
+			}
+			vc.Entries = append(vc.Entries, e)
+		}
+		v.Cards = append(v.Cards, vc)
+	}
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return errors.Wrap(err, "json.Encode error")
+		}
+		return nil
+	})
+}
+
+// vaultAttachments writes the entry's attachments to dir and returns them with
+// Data replaced by a Path relative to base.
+func vaultAttachments(dir, base string, e entry) ([]attachment, error) {
+	var as []attachment
+	for i, a := range e.Attachments {
+		name := a.Name
+		if a.Image {
+			name = "image" + imageExt(sniffType(a.Data))
+		}
+		path := filepath.Join(dir, url.QueryEscape(e.CardID+"_"+strconv.Itoa(i)+"_"+name))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrap(err, "os.MkdirAll error")
+		}
+		data := a.Data
+		if err := writeFileAtomic(path, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}); err != nil {
+			return nil, errors.Wrap(err, "writeFileAtomic error")
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return nil, errors.Wrap(err, "filepath.Rel error")
+		}
+		a.Data = nil
+		a.Path = filepath.ToSlash(rel)
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+// readVault reads vault JSON written by dump, and possibly edited since, and
+// returns the entries of every card in order.  Attachments given by Path are
+// loaded relative to filename.
+//
+// Since version 3, the attachments of a card are only written to its first
+// entry, and every other entry without attachments of its own shares them.
+func readVault(filename string) ([][]entry, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile error")
+	}
+	var v vault
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal error")
+	}
+	if v.Version < 1 || v.Version > vaultVersion {
+		return nil, errors.Errorf("unsupported vault version %d, this build reads up to version %d", v.Version, vaultVersion)
+	}
+
+	var cards [][]entry
+	for _, vc := range v.Cards {
+		if len(vc.Entries) == 0 {
+			return nil, errors.Errorf("card %s has no entries", vc.ID)
+		}
+		for i := range vc.Entries {
+			e := &vc.Entries[i]
+			if e.CardID == "" {
+				e.CardID = vc.ID
+			}
+			if e.Kind != entrySite && e.Kind != entryNote {
+				return nil, errors.Errorf("card %s: unknown kind %q, must be %s or %s", vc.ID, e.Kind, entrySite, entryNote)
+			}
+			if e.Title == "" {
+				return nil, errors.Errorf("card %s: entry has no title", vc.ID)
+			}
+			for j := range e.Attachments {
+				a := &e.Attachments[j]
+				if a.Path == "" {
+					continue
+				}
+				path := filepath.FromSlash(a.Path)
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(filename), path)
+				}
+				if a.Data, err = ioutil.ReadFile(path); err != nil {
+					return nil, errors.Wrapf(err, "card %s: attachment", vc.ID)
+				}
+			}
+		}
+		if v.Version >= 3 {
+			for i := 1; i < len(vc.Entries); i++ {
+				if len(vc.Entries[i].Attachments) == 0 {
+					vc.Entries[i].Attachments = vc.Entries[0].Attachments
+				}
+			}
+		}
+		cards = append(cards, vc.Entries)
+	}
+	return cards, nil
+}